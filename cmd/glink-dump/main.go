@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/myxo/glink/pkg"
+)
+
+func main() {
+	raw := flag.Bool("raw", false, "print frame bytes along with decoded message")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-raw] dump-file\n\nPrints frames recorded by glink -dump-frames.\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalf("Cannot open dump: %s", err)
+	}
+	defer file.Close()
+
+	err = glink.ReadDump(file, func(rec glink.DumpRecord) error {
+		printRecord(rec, *raw)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("Cannot read dump: %s", err)
+	}
+}
+
+func printRecord(rec glink.DumpRecord, raw bool) {
+	peer := string(rec.Peer)
+	if peer == "" {
+		peer = "handshake"
+	}
+	fmt.Printf("%s %-3s %s (%s) ", rec.Time.Format("2006-01-02 15:04:05.000"), rec.Dir, peer, rec.Remote)
+
+	hdr, msg, err := rec.Decode()
+	if err != nil {
+		fmt.Printf("type=%s size=%d: cannot decode: %s\n", glink.GetTypeName(hdr.MsgType), hdr.PayloadSize, err)
+	} else {
+		fmt.Printf("type=%s size=%d codec=%s", glink.GetTypeName(hdr.MsgType), hdr.PayloadSize, rec.Codec)
+		if hdr.RequestId != 0 {
+			fmt.Printf(" request=%d", hdr.RequestId)
+		}
+		if hdr.Flags&glink.FlagResponse != 0 {
+			fmt.Printf(" response")
+		}
+		if hdr.Flags&glink.FlagCompressed != 0 {
+			fmt.Printf(" compressed")
+		}
+		pp, _ := json.MarshalIndent(msg, "  ", "  ")
+		fmt.Printf("\n  %s\n", pp)
+	}
+	if raw {
+		fmt.Printf("  % x\n", rec.Frame)
+	}
+}
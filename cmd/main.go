@@ -2,29 +2,89 @@ package main
 
 import (
 	// "bufio"
-	// "os"
 	"flag"
 	"log"
+	"os"
+	"strings"
 
 	"github.com/juju/loggo"
 	"github.com/myxo/glink/pkg"
 )
 
 func main() {
-	db_path := flag.String("db-path", "glink.db", "path to glink database")
+	config := glink.DefaultConfig()
+	flag.StringVar(&config.DbPath, "db-path", config.DbPath, "path to glink database")
+	flag.StringVar(&config.Server.ListenAddress, "listen", config.Server.ListenAddress, "host:port to accept peer connections on")
+	max_frame_size := flag.Uint("max-frame-size", uint(config.Server.MaxFrameSize), "max size of incoming network frame in bytes")
+	flag.StringVar(&config.Server.DumpFrames, "dump-frames", "", "record all network frames to this file, read it with glink-dump")
+	compress_threshold := flag.Uint("compress-threshold", uint(config.Server.CompressThreshold), "compress frames bigger than this size in bytes, 0 to disable")
+	flag.Float64Var(&config.Server.RateLimit.MsgRate, "msg-rate", config.Server.RateLimit.MsgRate, "messages of each type allowed per second from one peer, 0 to disable")
+	flag.Float64Var(&config.Server.RateLimit.ByteRate, "byte-rate", config.Server.RateLimit.ByteRate, "bytes allowed per second from one peer, 0 to disable")
+	flag.DurationVar(&config.Server.RateLimit.BanWindow, "ban-window", config.Server.RateLimit.BanWindow, "peers exceeding rate limits too often within this time are banned")
+	flag.DurationVar(&config.Server.RateLimit.BanDuration, "ban-duration", config.Server.RateLimit.BanDuration, "how long peers exceeding rate limits are refused")
+	flag.StringVar(&config.Discovery.Backend, "discovery", config.Discovery.Backend, "comma separated ways to find other nodes: multicast, mdns, static")
+	flag.StringVar(&config.Discovery.Group, "discovery-group", config.Discovery.Group, "IPv4 or IPv6 multicast group for node discovery, e.g. ff02::1")
+	flag.IntVar(&config.Discovery.Port, "discovery-port", config.Discovery.Port, "UDP port for node discovery")
+	flag.StringVar(&config.Discovery.Interface, "discovery-iface", "", "network interface for node discovery, system default if empty")
+	flag.IntVar(&config.Discovery.TTL, "discovery-ttl", config.Discovery.TTL, "TTL (hop limit) of discovery announces")
+	flag.DurationVar(&config.Discovery.NodeTimeout, "discovery-timeout", config.Discovery.NodeTimeout, "node is shown offline after this time without announces")
+	static_peers := flag.String("peers", "", "comma separated host:port list of peers for static discovery")
+	change_passphrase := flag.Bool("change-passphrase", false, "set, change or remove database passphrase and exit")
 	flag.Parse()
+	if *change_passphrase {
+		err := glink.ChangeDbPassphrase(config.DbPath)
+		if err != nil {
+			log.Fatalf("Cannot change passphrase: %s", err)
+		}
+		return
+	}
+	if *static_peers != "" {
+		config.Discovery.StaticPeers = strings.Split(*static_peers, ",")
+		if !strings.Contains(config.Discovery.Backend, glink.BackendStatic) {
+			config.Discovery.Backend += "," + glink.BackendStatic
+		}
+	}
+	config.Server.MaxFrameSize = uint32(*max_frame_size)
+	config.Server.CompressThreshold = uint32(*compress_threshold)
 
 	tui_logger := NewTuiLogger()
 	loggo.ReplaceDefaultWriter(tui_logger)
 	logger := loggo.GetLogger("default")
 	logger.SetLogLevel(loggo.DEBUG)
 
-	gservice, err := glink.NewGlinkService(&logger, *db_path)
+	gservice, err := glink.NewGlinkService(&logger, config)
 	if err != nil {
 		log.Fatalf("Cannot init service: %s", err)
 	}
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{&logger})
 	gservice.Launch()
 
 	tui := NewTui(gservice, tui_logger)
 	tui.Run()
+
+	// Tui is gone, nobody reads its log anymore.
+	loggo.ReplaceDefaultWriter(loggo.NewSimpleWriter(os.Stderr, loggo.DefaultFormatter))
+	logger.SetLogLevel(loggo.WARNING)
+	log.SetOutput(os.Stderr)
+	err = gservice.Stop()
+	if err != nil {
+		log.Fatalf("Cannot stop service: %s", err)
+	}
+}
+
+// stdLogWriter passes output of libraries using the standard log package to
+// loggo, it would break the tui otherwise. Only errors are worth showing.
+type stdLogWriter struct {
+	logger *loggo.Logger
+}
+
+func (w stdLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	if strings.HasPrefix(msg, "[ERR]") {
+		w.logger.Warningf("%s", msg)
+	} else {
+		w.logger.Tracef("%s", msg)
+	}
+	return len(p), nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strconv"
 	"strings"
 
 	"github.com/gdamore/tcell/v2"
@@ -12,6 +13,7 @@ import (
 type (
 	Tui struct {
 		app          *tview.Application
+		pages        *tview.Pages
 		gservice     *glink.GlinkService
 		model        *chatModel
 		view         *chatView
@@ -27,6 +29,9 @@ type (
 		Chats       []glink.ChatInfo
 		active_chat glink.Cid
 		uidToName   map[glink.Uid]string
+		verified    map[glink.Uid]bool
+		// online maps uids of reachable nodes to sources of glink.Presence.
+		online map[glink.Uid][]string
 	}
 
 	chatView struct {
@@ -61,6 +66,12 @@ func NewTui(gservice *glink.GlinkService, log_writer *TuiLogger) *Tui {
 	for _, info := range uids {
 		chat_model.uidToName[info.Uid] = info.Name
 	}
+	chat_model.verified, err = gservice.Db.GetVerifiedUids()
+	if err != nil {
+		log_writer.Errorf("Cannot get verified contacts: %s", err)
+		chat_model.verified = make(map[glink.Uid]bool)
+	}
+	chat_model.online = make(map[glink.Uid][]string)
 
 	log_writer.Infof("Active chat: %s", chat_model.active_chat)
 
@@ -82,6 +93,7 @@ func NewTui(gservice *glink.GlinkService, log_writer *TuiLogger) *Tui {
 
 	tui := Tui{
 		app:          app,
+		pages:        tview.NewPages(),
 		gservice:     gservice,
 		model:        &chat_model,
 		view:         &chatView{chat: chatArea, logs: logArea, chatList: chatList},
@@ -133,6 +145,14 @@ func NewTui(gservice *glink.GlinkService, log_writer *TuiLogger) *Tui {
 	tui.refreshChatList()
 	tui.refreshMessages()
 
+	invites, err := gservice.Db.GetIncomingInvites()
+	if err != nil {
+		log_writer.Warnf("Cannot get incoming invites: %s", err)
+	}
+	for _, invite := range invites {
+		tui.showIncomingInvite(invite)
+	}
+
 	go func() {
 		for {
 			select {
@@ -144,11 +164,16 @@ func NewTui(gservice *glink.GlinkService, log_writer *TuiLogger) *Tui {
 		}
 	}()
 
-	app.SetRoot(grid, true).SetFocus(inputField).EnableMouse(false)
+	tui.pages.AddPage("main", grid, true, true)
+	app.SetRoot(tui.pages, true).SetFocus(inputField).EnableMouse(false)
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
 		if event.Key() == tcell.KeyCtrlC {
 			return event
 		}
+		if front, _ := tui.pages.GetFrontPage(); front != "main" {
+			// Modal dialog owns the keyboard.
+			return event
+		}
 		if event.Key() == tcell.KeyUp {
 			tui.MoveFocusUp()
 			return nil
@@ -175,6 +200,34 @@ func (t *Tui) processEvent(ev interface{}) {
 		}
 		t.refreshMessages()
 
+	case glink.KeyChangeWarning:
+		t.showKeyChangeWarning(ev)
+
+	case glink.SafetyNumberInfo:
+		t.showSafetyNumber(ev)
+
+	case glink.IncomingInvite:
+		t.showIncomingInvite(ev)
+
+	case glink.InviteDeclined:
+		if ev.Removed {
+			t.removeChat(ev.Chat.Cid)
+		}
+		t.showInviteDeclined(ev)
+
+	case glink.Presence:
+		if ev.Online {
+			t.model.online[ev.Uid] = ev.Sources
+		} else {
+			delete(t.model.online, ev.Uid)
+		}
+		t.refreshChatList()
+
+	case glink.ContactVerified:
+		t.model.verified[ev.Uid] = ev.Verified
+		t.refreshChatList()
+		t.refreshMessages()
+
 	case glink.ChatUpdate:
 		t.model.active_chat = ev.Info.Cid
 		for _, ci := range t.model.Chats {
@@ -190,6 +243,159 @@ func (t *Tui) processEvent(ev interface{}) {
 	}
 }
 
+func (t *Tui) showKeyChangeWarning(ev glink.KeyChangeWarning) {
+	page := "key-change-" + string(ev.Uid)
+	if t.pages.HasPage(page) {
+		return
+	}
+	text := "WARNING: " + ev.Name + " (" + string(ev.Uid) + ") comes with a new identity key!\n\n" +
+		"Someone may be impersonating your contact " + ev.Name + ". Connections are refused until you accept the new key as one more contact.\n\n" +
+		"Known: " + glink.Fingerprint(ev.PinnedKey) + "\n" +
+		"New:   " + glink.Fingerprint(ev.NewKey)
+	modal := tview.NewModal().
+		SetText(text).
+		SetBackgroundColor(tcell.ColorDarkRed).
+		AddButtons([]string{"Reject", "Accept new key"}).
+		SetDoneFunc(func(_ int, label string) {
+			if label == "Accept new key" {
+				t.gservice.AcceptKeyChange(ev)
+			} else {
+				t.gservice.RejectKeyChange(ev)
+			}
+			t.pages.RemovePage(page)
+			t.RefreshFocus()
+		})
+	t.pages.AddPage(page, modal, false, true)
+	t.app.SetFocus(modal)
+}
+
+func (t *Tui) showSafetyNumber(ev glink.SafetyNumberInfo) {
+	page := "safety-number-" + string(ev.Uid)
+	if t.pages.HasPage(page) {
+		return
+	}
+	text := "Safety number with " + ev.Name + ":\n\n" + ev.Number + "\n\n" +
+		"Compare it with the number " + ev.Name + " sees. Mark the contact verified only if they match."
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Close", "Mark verified"}).
+		SetDoneFunc(func(_ int, label string) {
+			if label == "Mark verified" {
+				t.gservice.SetVerified(ev.Uid, true)
+			}
+			t.pages.RemovePage(page)
+			t.RefreshFocus()
+		})
+	t.pages.AddPage(page, modal, false, true)
+	t.app.SetFocus(modal)
+}
+
+// showIncomingInvite asks whether to join the chat. Later keeps the invite,
+// it can be answered with !accept or !decline.
+func (t *Tui) showIncomingInvite(ev glink.IncomingInvite) {
+	page := "invite-" + string(ev.Chat.Cid)
+	if t.pages.HasPage(page) {
+		return
+	}
+	text := t.GetNameByUid(ev.From) + " invites you to chat " + ev.Chat.Name
+	if ev.Chat.Group {
+		text += " with " + strconv.Itoa(len(ev.Chat.Participants)) + " participants"
+	}
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Accept", "Decline", "Later"}).
+		SetDoneFunc(func(_ int, label string) {
+			switch label {
+			case "Accept":
+				t.gservice.AcceptInvite(ev.Chat.Cid)
+			case "Decline":
+				t.gservice.DeclineInvite(ev.Chat.Cid)
+			}
+			t.pages.RemovePage(page)
+			t.RefreshFocus()
+		})
+	t.pages.AddPage(page, modal, false, true)
+	t.app.SetFocus(modal)
+}
+
+// showInviteDeclined tells the user that invite they sent was declined.
+func (t *Tui) showInviteDeclined(ev glink.InviteDeclined) {
+	page := "invite-declined-" + string(ev.Chat.Cid)
+	if t.pages.HasPage(page) {
+		return
+	}
+	text := t.GetNameByUid(ev.From) + " declined invite to chat " + ev.Chat.Name
+	if ev.Removed {
+		text += ", the chat is removed"
+	}
+	modal := tview.NewModal().
+		SetText(text).
+		AddButtons([]string{"Close"}).
+		SetDoneFunc(func(_ int, _ string) {
+			t.pages.RemovePage(page)
+			t.RefreshFocus()
+		})
+	t.pages.AddPage(page, modal, false, true)
+	t.app.SetFocus(modal)
+}
+
+func (t *Tui) removeChat(cid glink.Cid) {
+	for i, chat := range t.model.Chats {
+		if chat.Cid == cid {
+			t.model.Chats = append(t.model.Chats[:i], t.model.Chats[i+1:]...)
+			break
+		}
+	}
+	delete(t.model.Msgs, cid)
+	if t.model.active_chat == cid {
+		t.model.active_chat = ""
+		if len(t.model.Chats) != 0 {
+			t.model.active_chat = t.model.Chats[0].Cid
+		}
+	}
+	t.refreshChatList()
+	t.refreshMessages()
+}
+
+// onlineCount is the number of other chat participants reachable right now.
+func (t *Tui) onlineCount(chat glink.ChatInfo) int {
+	count := 0
+	for _, uid := range chat.Participants {
+		if _, online := t.model.online[uid]; online && uid != t.model.own_info.Uid {
+			count++
+		}
+	}
+	return count
+}
+
+// sourceOf tells how other participant of direct chat is reachable.
+func (t *Tui) sourceOf(chat glink.ChatInfo) string {
+	for _, uid := range chat.Participants {
+		if sources, ok := t.model.online[uid]; ok && uid != t.model.own_info.Uid {
+			if len(sources) == 0 {
+				return "connection"
+			}
+			return strings.Join(sources, ", ")
+		}
+	}
+	return ""
+}
+
+// isChatVerified is true if all other participants of the chat are verified.
+func (t *Tui) isChatVerified(chat glink.ChatInfo) bool {
+	others := 0
+	for _, uid := range chat.Participants {
+		if uid == "" || uid == t.model.own_info.Uid {
+			continue
+		}
+		if !t.model.verified[uid] {
+			return false
+		}
+		others++
+	}
+	return others != 0
+}
+
 func (t *Tui) processLog(log_entry loggo.Entry) {
 	t.model.Logs = append(t.model.Logs, log_entry)
 	t.refreshMessages()
@@ -215,6 +421,16 @@ func (t *Tui) refreshChatList() {
 		if name == "" && !chat.Group {
 			// other guy name
 		}
+		if t.isChatVerified(chat) {
+			name += " ✓"
+		}
+		if online := t.onlineCount(chat); online == 0 {
+			name = "○ " + name
+		} else if chat.Group {
+			name = "[green]●[-] " + name + " (" + strconv.Itoa(online) + " online)"
+		} else {
+			name = "[green]●[-] " + name + " via " + t.sourceOf(chat)
+		}
 		t.view.chatList.AddItem(name, "", 'a'+rune(i), func() {
 			new_active_chat := t.model.Chats[iCopy].Cid
 			if new_active_chat != t.model.active_chat {
@@ -229,6 +445,9 @@ func (t *Tui) refreshMessages() {
 	msgs := make([]string, 0, 10)
 	for _, msg := range t.model.Msgs[t.model.active_chat] {
 		name := t.GetNameByUid(msg.Uid)
+		if t.model.verified[msg.Uid] {
+			name += "[green]✓"
+		}
 		text := "[blue]" + name + "[white]: " + msg.Text
 		msgs = append(msgs, text)
 
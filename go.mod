@@ -3,13 +3,19 @@ module github.com/myxo/glink
 go 1.18
 
 require (
+	github.com/fxamacker/cbor/v2 v2.5.0
 	github.com/gdamore/tcell/v2 v2.5.1
+	github.com/golang/snappy v0.0.4
 	github.com/google/uuid v1.3.0
+	github.com/hashicorp/mdns v1.0.5
 	github.com/juju/loggo v0.0.0-20210728185423-eebad3a902c4
 	github.com/mattn/go-sqlite3 v1.14.13
 	github.com/rivo/tview v0.0.0-20220307222120-9994674d60a8
 	github.com/stretchr/testify v1.7.1
 	go.uber.org/atomic v1.9.0
+	golang.org/x/crypto v0.23.0
+	golang.org/x/net v0.25.0
+	golang.org/x/term v0.20.0
 )
 
 require (
@@ -17,10 +23,11 @@ require (
 	github.com/gdamore/encoding v1.0.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.13 // indirect
+	github.com/miekg/dns v1.1.41 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
-	golang.org/x/sys v0.0.0-20220318055525-2edf467146b5 // indirect
-	golang.org/x/term v0.0.0-20210220032956-6a3ed077a48d // indirect
-	golang.org/x/text v0.3.7 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.15.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,230 @@
+package glink
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// At rest encryption protects db content with a key derived from user
+// passphrase. Db without passphrase keeps values as is. Sealed values are
+// nonce followed by secretbox ciphertext.
+
+var (
+	ErrWrongPassphrase = errors.New("Wrong passphrase")
+	ErrDbLocked        = errors.New("Db is encrypted, passphrase is required")
+)
+
+// Argon2id parameters, see RFC 9106 recommendations for memory constrained
+// environments.
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	saltSize   = 16
+)
+
+var passphraseCheck = []byte("glink passphrase check")
+
+// encryptedColumns are the columns with user content and key material. Text
+// columns keep TEXT type when db has no passphrase.
+var encryptedColumns = []struct {
+	table  string
+	column string
+	text   bool
+}{
+	{"secret", "value", false},
+	{"chat", "name", true},
+	{"chat", "chat_key", false},
+	{"message", "msg", true},
+	{"incoming_invite", "name", true},
+	{"incoming_invite", "chat_key", false},
+}
+
+func deriveAtRestKey(passphrase string, salt []byte) *[32]byte {
+	key := new([32]byte)
+	copy(key[:], argon2.IDKey([]byte(passphrase), salt, kdfTime, kdfMemory, kdfThreads, 32))
+	return key
+}
+
+// IsEncrypted is true if db has passphrase. Such db must be unlocked before
+// use.
+func (d *Db) IsEncrypted() bool {
+	var count int
+	err := d.db.QueryRow(`SELECT COUNT(*) FROM crypt`).Scan(&count)
+	return err == nil && count != 0
+}
+
+func (d *Db) Unlock(passphrase string) error {
+	var salt, check []byte
+	err := d.db.QueryRow(`SELECT salt, check_value FROM crypt`).Scan(&salt, &check)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	key := deriveAtRestKey(passphrase, salt)
+	_, err = openValue(key, check)
+	if err != nil {
+		return ErrWrongPassphrase
+	}
+	d.atRest = key
+	return nil
+}
+
+// ChangePassphrase reencrypts db content with the new passphrase. Empty
+// passphrase turns encryption off. Encrypted db must be unlocked first.
+func (d *Db) ChangePassphrase(passphrase string) error {
+	if d.atRest == nil && d.IsEncrypted() {
+		return ErrDbLocked
+	}
+	var key *[32]byte
+	var salt []byte
+	if passphrase != "" {
+		salt = make([]byte, saltSize)
+		_, err := io.ReadFull(rand.Reader, salt)
+		if err != nil {
+			return err
+		}
+		key = deriveAtRestKey(passphrase, salt)
+	}
+
+	// Old values must not stay in the file: secure_delete zeroes pages they
+	// are removed from, VACUUM rebuilds the file without free pages.
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `PRAGMA secure_delete = ON`)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = recrypt(tx, d.atRest, key, salt)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Cannot reencrypt db: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	d.atRest = key
+	_, err = conn.ExecContext(ctx, `VACUUM`)
+	if err != nil {
+		return fmt.Errorf("Cannot vacuum db: %w", err)
+	}
+	return nil
+}
+
+func recrypt(tx *sql.Tx, from, to *[32]byte, salt []byte) error {
+	for _, col := range encryptedColumns {
+		rows, err := tx.Query(fmt.Sprintf(`SELECT rowid, %s FROM %s`, col.column, col.table))
+		if err != nil {
+			return err
+		}
+		values := make(map[int64][]byte)
+		for rows.Next() {
+			var rowid int64
+			var value []byte
+			err = rows.Scan(&rowid, &value)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			values[rowid], err = openValue(from, value)
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("%s.%s: %w", col.table, col.column, err)
+			}
+		}
+		rows.Close()
+
+		query := fmt.Sprintf(`UPDATE %s SET %s = ? WHERE rowid = ?`, col.table, col.column)
+		for rowid, value := range values {
+			sealed, err := sealValue(to, value, col.text)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(query, sealed, rowid)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := tx.Exec(`DELETE FROM crypt`)
+	if err != nil || to == nil {
+		return err
+	}
+	check, err := sealValue(to, passphraseCheck, false)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO crypt (salt, check_value) VALUES (?, ?)`, salt, check)
+	return err
+}
+
+// sealValue returns value ready to be stored in db. NULL and empty values are
+// not encrypted, they don't carry any content.
+func sealValue(key *[32]byte, value []byte, text bool) (any, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if key == nil || len(value) == 0 {
+		if text {
+			return string(value), nil
+		}
+		return value, nil
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], value, nonce, key), nil
+}
+
+func openValue(key *[32]byte, value []byte) ([]byte, error) {
+	if key == nil || len(value) == 0 {
+		return value, nil
+	}
+	if len(value) < nonceSize {
+		return nil, ErrCannotDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], value)
+	res, ok := secretbox.Open(nil, value[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, ErrCannotDecrypt
+	}
+	return res, nil
+}
+
+func (d *Db) seal(value []byte) (any, error) {
+	return sealValue(d.atRest, value, false)
+}
+
+func (d *Db) sealText(value string) (any, error) {
+	return sealValue(d.atRest, []byte(value), true)
+}
+
+func (d *Db) open(value []byte) ([]byte, error) {
+	return openValue(d.atRest, value)
+}
+
+func (d *Db) openText(value []byte) (string, error) {
+	res, err := openValue(d.atRest, value)
+	return string(res), err
+}
@@ -0,0 +1,70 @@
+package glink
+
+import (
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// Codec turns message structs into frame payload and back.
+type Codec interface {
+	Name() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+type JsonCodec struct{}
+
+func (JsonCodec) Name() string                       { return "json" }
+func (JsonCodec) Marshal(v any) ([]byte, error)      { return json.Marshal(v) }
+func (JsonCodec) Unmarshal(data []byte, v any) error { return json.Unmarshal(data, v) }
+
+type CborCodec struct{}
+
+func (CborCodec) Name() string                       { return "cbor" }
+func (CborCodec) Marshal(v any) ([]byte, error)      { return cbor.Marshal(v) }
+func (CborCodec) Unmarshal(data []byte, v any) error { return cbor.Unmarshal(data, v) }
+
+// DefaultCodec is used for handshake and discovery messages, and for
+// connections with peers that do not announce any codecs.
+var DefaultCodec Codec = JsonCodec{}
+
+// knownCodecs is ordered by preference. Order must be the same in every build,
+// so both sides of a connection pick the same codec.
+var knownCodecs = []Codec{CborCodec{}, JsonCodec{}}
+
+func codecNames(codecs []Codec) []string {
+	names := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+func CodecByName(name string) Codec {
+	for _, c := range knownCodecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// negotiateCodec picks the most preferred codec supported by both sides.
+func negotiateCodec(own, peer []string) Codec {
+	for _, c := range knownCodecs {
+		if contains(own, c.Name()) && contains(peer, c.Name()) {
+			return c
+		}
+	}
+	return DefaultCodec
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
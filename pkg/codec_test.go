@@ -0,0 +1,30 @@
+package glink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecsRoundTrip(t *testing.T) {
+	msg := HaveCidInfo{
+		From: "uid1",
+		To:   "uid2",
+		ChatsVectorClock: map[Cid]VectorClock{
+			"cid1": {"uid1": 2, "uid2": 1},
+		},
+	}
+	for _, codec := range knownCodecs {
+		bytes, err := EncodeMsgWith(codec, ProtocolVersion, msg)
+		require.Nil(t, err)
+		decoded, err := DecodeMsgWith[HaveCidInfo](codec, bytes.Payload)
+		require.Nil(t, err, codec.Name())
+		require.Equal(t, msg, decoded, codec.Name())
+	}
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	require.Equal(t, "cbor", negotiateCodec([]string{"json", "cbor"}, []string{"cbor", "json"}).Name())
+	require.Equal(t, "json", negotiateCodec([]string{"json", "cbor"}, []string{"json"}).Name())
+	require.Equal(t, "json", negotiateCodec([]string{"json", "cbor"}, nil).Name())
+}
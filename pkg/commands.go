@@ -1,23 +1,38 @@
 package glink
 
-import (
-	"fmt"
-	"reflect"
-)
-
 type Uid string
 type Cid string
 
+// Wire ids are part of the protocol: never change or reuse them.
+func init() {
+	registerMsg[NodeAnnounce](1, nil)
+	registerMsg(2, (*GlinkService).onInviteForJoin)
+	registerMsg(3, (*GlinkService).onJoinChat)
+	registerMsg(4, (*GlinkService).onChatMessage)
+	registerMsg[ConnectInfo](5, nil)
+	registerRequestMsg(6, (*GlinkService).onWatchedCids)
+	registerMsg[HaveCidInfo](7, nil)
+	registerRequestMsg(8, (*GlinkService).onMessagesRequest)
+	registerMsg(9, (*GlinkService).onChatMessagePack)
+	registerMsg[ConnectRefused](10, nil)
+	registerMsg(11, (*GlinkService).onDeclineInvite)
+}
+
+// NodeAnnounce is signed by identity key, see Identity.SignAnnounce.
 type NodeAnnounce struct {
-	Uid      Uid
-	Name     string
-	Endpoint string
+	Uid       Uid
+	Name      string
+	Endpoint  string
+	PublicKey []byte
+	Signature []byte
 }
 
 type InviteForJoin struct {
 	From Uid
 	To   Uid
 	Chat ChatInfo
+	// SealedKey is the chat key encrypted for To, see SealChatKey.
+	SealedKey []byte
 }
 
 type JoinChat struct {
@@ -26,16 +41,41 @@ type JoinChat struct {
 	Cid  Cid
 }
 
+// DeclineInvite answers InviteForJoin the user refused.
+type DeclineInvite struct {
+	From Uid
+	To   Uid
+	Cid  Cid
+}
+
+// ChatMessage travels over the wire and is stored with empty Text: only
+// participants of the chat can get it from Sealed, see SealText. Author signs
+// the message, so it can be verified after relay, see Identity.SignMessage.
 type ChatMessage struct {
-	Uid   Uid
-	Cid   Cid
-	Text  string
-	Index uint32
+	Uid       Uid
+	Cid       Cid
+	Text      string `json:",omitempty"`
+	Index     uint32
+	Sealed    []byte
+	Signature []byte
+	AuthorKey []byte
 }
 
 type ConnectInfo struct {
-	MyUid  Uid
-	MyName string
+	MyUid      Uid
+	MyName     string
+	MinVersion uint16
+	MaxVersion uint16
+	Features   []string
+	Codecs     []string
+	// BoxKey is the public key peers use to send us chat keys.
+	BoxKey []byte
+	// IdentityKey must match the key of TLS certificate.
+	IdentityKey []byte
+}
+
+type ConnectRefused struct {
+	Reason string
 }
 
 type WatchedCids struct {
@@ -62,6 +102,20 @@ type ChatMessagePack struct {
 	Messages []ChatMessage
 }
 
+// sentBy is implemented by messages that name their sender. The name must
+// match the peer the message came from.
+type sentBy interface {
+	sender() Uid
+}
+
+func (m InviteForJoin) sender() Uid   { return m.From }
+func (m JoinChat) sender() Uid        { return m.From }
+func (m WatchedCids) sender() Uid     { return m.From }
+func (m HaveCidInfo) sender() Uid     { return m.From }
+func (m MessagesRequest) sender() Uid { return m.From }
+func (m ChatMessagePack) sender() Uid { return m.From }
+func (m DeclineInvite) sender() Uid   { return m.From }
+
 // -------------- Common ------------------------
 type ChatInfo struct {
 	Cid          Cid
@@ -83,29 +137,50 @@ type ChatUpdate struct {
 	NewUids []Uid
 }
 
-func GetTypeId(cmd any) (uint16, error) {
-	name := reflect.TypeOf(cmd).Name()
-	switch name {
-	case "NodeAnnounce":
-		return 1, nil
-	case "InviteForJoin":
-		return 2, nil
-	case "JoinResponce":
-		return 3, nil
-	case "ChatMessage":
-		return 4, nil
-	case "ConnectInfo":
-		return 5, nil
-	case "WatchedCids":
-		return 6, nil
-	case "HaveCidInfo":
-		return 7, nil
-	case "MessagesRequest":
-		return 8, nil
-	case "ChatMessagePack":
-		return 9, nil
-	}
-
-	return 0, fmt.Errorf("Unknown command type %s", name)
+// IncomingInvite waits for user decision, see GlinkService.AcceptInvite and
+// GlinkService.DeclineInvite.
+type IncomingInvite struct {
+	From Uid
+	Chat ChatInfo
+}
+
+// InviteDeclined tells that From declined invite to Chat. Chat made only for
+// the invite has nobody else in it, so it is removed.
+type InviteDeclined struct {
+	From    Uid
+	Chat    ChatInfo
+	Removed bool
+}
+
+// Presence tells whether the node is reachable right now. Sources are the
+// discovery backends that see the node, and static or manual for connection
+// made by address. Node with live connection is online even without sources.
+type Presence struct {
+	Uid     Uid
+	Online  bool
+	Sources []string
+}
+
+// SafetyNumberInfo is shown to user on !verify command.
+type SafetyNumberInfo struct {
+	Uid    Uid
+	Name   string
+	Number string
+}
+
+type ContactVerified struct {
+	Uid      Uid
+	Verified bool
+}
 
+// KeyChangeWarning is sent to UI when unknown Uid comes with the name of a
+// known contact, since Uid changes together with identity key. Uid is
+// refused until user accepts it with GlinkService.AcceptKeyChange. Warning
+// dismissed with GlinkService.RejectKeyChange comes again next time.
+type KeyChangeWarning struct {
+	Uid       Uid
+	Name      string
+	KnownUid  Uid
+	PinnedKey []byte
+	NewKey    []byte
 }
@@ -0,0 +1,15 @@
+package glink
+
+type Config struct {
+	DbPath    string
+	Server    ServerConfig
+	Discovery DiscoveryConfig
+}
+
+func DefaultConfig() Config {
+	return Config{
+		DbPath:    "glink.db",
+		Server:    DefaultServerConfig(),
+		Discovery: DefaultDiscoveryConfig(),
+	}
+}
@@ -0,0 +1,312 @@
+package glink
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+const nonceSize = 24
+
+var (
+	ErrCannotDecrypt = errors.New("Cannot decrypt")
+	ErrNoChatKey     = errors.New("No key for chat")
+	ErrBadSignature  = errors.New("Bad signature")
+	ErrKeyChanged    = errors.New("Identity key changed")
+)
+
+// BoxKeyPair is a curve25519 key pair used to pass chat keys between users.
+type BoxKeyPair struct {
+	Public  *[32]byte
+	Private *[32]byte
+}
+
+// Identity holds own key material. It is created on first start and kept in
+// the secret table of Db.
+type Identity struct {
+	Box BoxKeyPair
+	// Sign is the long term identity key, it authenticates connections.
+	Sign ed25519.PrivateKey
+}
+
+const (
+	secretBoxPrivate  = "box_private"
+	secretSignPrivate = "sign_private"
+)
+
+// LoadIdentity reads own keys from db, generating them on first start.
+func LoadIdentity(db *Db) (*Identity, error) {
+	private, err := loadOrCreateSecret(db, secretBoxPrivate)
+	if err != nil {
+		return nil, err
+	}
+	pair, err := boxKeyPairFromPrivate(private)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := loadOrCreateSecret(db, secretSignPrivate)
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("Wrong sign key size %d", len(seed))
+	}
+	return &Identity{Box: pair, Sign: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// loadOrCreateSecret returns 32 bytes secret, filling it with random bytes if
+// it is not in db yet.
+func loadOrCreateSecret(db *Db, name string) ([]byte, error) {
+	secret, err := db.GetSecret(name)
+	if err != nil || secret != nil {
+		return secret, err
+	}
+	secret = make([]byte, 32)
+	_, err = io.ReadFull(rand.Reader, secret)
+	if err != nil {
+		return nil, err
+	}
+	return secret, db.SetSecret(name, secret)
+}
+
+// SignKey returns public part of the identity key.
+func (i *Identity) SignKey() ed25519.PublicKey {
+	return i.Sign.Public().(ed25519.PublicKey)
+}
+
+// Uid is derived from the identity key, so nobody can use it without the key.
+func (i *Identity) Uid() Uid {
+	return UidFromKey(i.SignKey())
+}
+
+func UidFromKey(key ed25519.PublicKey) Uid {
+	sum := sha256.Sum256(key)
+	return Uid(hex.EncodeToString(sum[:16]))
+}
+
+// verifyUidKey checks that key has right size and uid is derived from it.
+func verifyUidKey(uid Uid, key []byte) error {
+	if len(key) != ed25519.PublicKeySize {
+		return fmt.Errorf("Wrong identity key size %d", len(key))
+	}
+	if UidFromKey(key) != uid {
+		return fmt.Errorf("Uid %s does not belong to the identity key", uid)
+	}
+	return nil
+}
+
+// SignAnnounce fills PublicKey and Signature of own NodeAnnounce.
+func (i *Identity) SignAnnounce(announce NodeAnnounce) NodeAnnounce {
+	announce.PublicKey = i.SignKey()
+	announce.Signature = ed25519.Sign(i.Sign, announceSignedBytes(announce))
+	return announce
+}
+
+// VerifyAnnounce checks that announce is signed by the owner of its Uid.
+func VerifyAnnounce(announce NodeAnnounce) error {
+	err := verifyUidKey(announce.Uid, announce.PublicKey)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(announce.PublicKey, announceSignedBytes(announce), announce.Signature) {
+		return fmt.Errorf("%w of %s announce", ErrBadSignature, announce.Uid)
+	}
+	return nil
+}
+
+// SignMessage fills AuthorKey and Signature of own message. Signature covers
+// ciphertext, so Sealed must be already set.
+func (i *Identity) SignMessage(msg ChatMessage) ChatMessage {
+	msg.AuthorKey = i.SignKey()
+	msg.Signature = ed25519.Sign(i.Sign, messageSignedBytes(msg))
+	return msg
+}
+
+// VerifyMessage checks that message is signed by its author.
+func VerifyMessage(msg ChatMessage) error {
+	err := verifyUidKey(msg.Uid, msg.AuthorKey)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(msg.AuthorKey, messageSignedBytes(msg), msg.Signature) {
+		return fmt.Errorf("%w of message %d from %s in chat %s", ErrBadSignature, msg.Index, msg.Uid, msg.Cid)
+	}
+	return nil
+}
+
+func messageSignedBytes(msg ChatMessage) []byte {
+	return signedFields("glink message", string(msg.Uid), string(msg.Cid), strconv.FormatUint(uint64(msg.Index), 10), string(msg.Sealed))
+}
+
+// SafetyNumber is derived from identity keys of both users and doesn't
+// depend on the order of keys, so both sides see the same digits.
+func SafetyNumber(own, peer []byte) string {
+	first, second := own, peer
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+	sum := sha256.Sum256(signedFields("glink safety number", string(first), string(second)))
+	groups := make([]string, 0, 6)
+	for i := 0; i+5 <= len(sum); i += 5 {
+		var chunk uint64
+		for _, b := range sum[i : i+5] {
+			chunk = chunk<<8 | uint64(b)
+		}
+		groups = append(groups, fmt.Sprintf("%05d", chunk%100000))
+	}
+	return strings.Join(groups, " ")
+}
+
+// Fingerprint is a short human readable form of the key.
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	digits := hex.EncodeToString(sum[:16])
+	groups := make([]string, 0, len(digits)/4)
+	for i := 0; i < len(digits); i += 4 {
+		groups = append(groups, digits[i:i+4])
+	}
+	return strings.Join(groups, " ")
+}
+
+func announceSignedBytes(announce NodeAnnounce) []byte {
+	return signedFields("glink announce", string(announce.Uid), announce.Name, announce.Endpoint)
+}
+
+// signedFields joins fields with length prefixes, so different field values
+// never produce the same bytes. First field names purpose of the signature.
+func signedFields(fields ...string) []byte {
+	var res []byte
+	var size [4]byte
+	for _, field := range fields {
+		binary.LittleEndian.PutUint32(size[:], uint32(len(field)))
+		res = append(res, size[:]...)
+		res = append(res, field...)
+	}
+	return res
+}
+
+func boxKeyPairFromPrivate(private []byte) (BoxKeyPair, error) {
+	if len(private) != 32 {
+		return BoxKeyPair{}, fmt.Errorf("Wrong box key size %d", len(private))
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return BoxKeyPair{}, err
+	}
+	pair := BoxKeyPair{Public: new([32]byte), Private: new([32]byte)}
+	copy(pair.Private[:], private)
+	copy(pair.Public[:], public)
+	return pair, nil
+}
+
+func GenerateBoxKeyPair() (BoxKeyPair, error) {
+	public, private, err := box.GenerateKey(rand.Reader)
+	return BoxKeyPair{Public: public, Private: private}, err
+}
+
+func GenerateIdentity() (*Identity, error) {
+	pair, err := GenerateBoxKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	_, sign, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{Box: pair, Sign: sign}, nil
+}
+
+func NewChatKey() ([]byte, error) {
+	key := make([]byte, 32)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+func newNonce() (*[nonceSize]byte, error) {
+	nonce := new([nonceSize]byte)
+	_, err := io.ReadFull(rand.Reader, nonce[:])
+	return nonce, err
+}
+
+func toKey(key []byte) (*[32]byte, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Wrong key size %d", len(key))
+	}
+	res := new([32]byte)
+	copy(res[:], key)
+	return res, nil
+}
+
+// SealChatKey encrypts chat key for the peer, so only the peer can read it and
+// can be sure it came from us. Result is nonce followed by ciphertext.
+func SealChatKey(chatKey []byte, peerPublic []byte, own BoxKeyPair) ([]byte, error) {
+	peer, err := toKey(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	return box.Seal(nonce[:], chatKey, nonce, peer, own.Private), nil
+}
+
+func OpenChatKey(sealed []byte, peerPublic []byte, own BoxKeyPair) ([]byte, error) {
+	peer, err := toKey(peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < nonceSize {
+		return nil, ErrCannotDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	key, ok := box.Open(nil, sealed[nonceSize:], &nonce, peer, own.Private)
+	if !ok {
+		return nil, ErrCannotDecrypt
+	}
+	return key, nil
+}
+
+// SealText encrypts message text with chat key. Result is nonce followed by
+// ciphertext.
+func SealText(text string, chatKey []byte) ([]byte, error) {
+	key, err := toKey(chatKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], []byte(text), nonce, key), nil
+}
+
+func OpenText(sealed []byte, chatKey []byte) (string, error) {
+	key, err := toKey(chatKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < nonceSize {
+		return "", ErrCannotDecrypt
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], sealed)
+	text, ok := secretbox.Open(nil, sealed[nonceSize:], &nonce, key)
+	if !ok {
+		return "", ErrCannotDecrypt
+	}
+	return string(text), nil
+}
@@ -0,0 +1,88 @@
+package glink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdentity(t *testing.T) *Identity {
+	identity, err := GenerateIdentity()
+	require.Nil(t, err)
+	return identity
+}
+
+func TestLoadIdentityIsPersistent(t *testing.T) {
+	db, err := NewDb("")
+	require.Nil(t, err)
+	first, err := LoadIdentity(db)
+	require.Nil(t, err)
+	second, err := LoadIdentity(db)
+	require.Nil(t, err)
+	require.Equal(t, first.Box, second.Box)
+	require.Equal(t, first.Sign, second.Sign)
+}
+
+func TestChatKeyExchange(t *testing.T) {
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	eve := newTestIdentity(t)
+	key, err := NewChatKey()
+	require.Nil(t, err)
+
+	sealed, err := SealChatKey(key, bob.Box.Public[:], alice.Box)
+	require.Nil(t, err)
+	opened, err := OpenChatKey(sealed, alice.Box.Public[:], bob.Box)
+	require.Nil(t, err)
+	require.Equal(t, key, opened)
+
+	_, err = OpenChatKey(sealed, alice.Box.Public[:], eve.Box)
+	require.ErrorIs(t, err, ErrCannotDecrypt)
+}
+
+func TestSealText(t *testing.T) {
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	other, err := NewChatKey()
+	require.Nil(t, err)
+
+	sealed, err := SealText("hello", key)
+	require.Nil(t, err)
+	require.NotContains(t, string(sealed), "hello")
+	text, err := OpenText(sealed, key)
+	require.Nil(t, err)
+	require.Equal(t, "hello", text)
+
+	_, err = OpenText(sealed, other)
+	require.ErrorIs(t, err, ErrCannotDecrypt)
+	_, err = OpenText(sealed[:10], key)
+	require.ErrorIs(t, err, ErrCannotDecrypt)
+}
+
+func TestSignedAnnounce(t *testing.T) {
+	alice := newTestIdentity(t)
+	mallory := newTestIdentity(t)
+	announce := alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+	require.Nil(t, VerifyAnnounce(announce))
+
+	moved := announce
+	moved.Endpoint = "127.0.0.1:2"
+	require.ErrorIs(t, VerifyAnnounce(moved), ErrBadSignature)
+
+	// Mallory can sign with own key, but the key doesn't match alice's uid.
+	forged := mallory.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+	require.NotNil(t, VerifyAnnounce(forged))
+
+	require.NotNil(t, VerifyAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice"}))
+}
+
+func TestSafetyNumberIsSymmetric(t *testing.T) {
+	alice := newTestIdentity(t)
+	bob := newTestIdentity(t)
+	eve := newTestIdentity(t)
+
+	number := SafetyNumber(alice.SignKey(), bob.SignKey())
+	require.Equal(t, number, SafetyNumber(bob.SignKey(), alice.SignKey()))
+	require.NotEqual(t, number, SafetyNumber(alice.SignKey(), eve.SignKey()))
+	require.Regexp(t, `^\d{5}( \d{5}){5}$`, number)
+}
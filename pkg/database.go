@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -17,6 +18,8 @@ type UserLightInfo struct {
 type Db struct {
 	db       *sql.DB
 	own_info UserLightInfo
+	// atRest is nil if db has no passphrase, see atrest.go.
+	atRest *[32]byte
 }
 
 func NewDb(path string) (*Db, error) {
@@ -60,6 +63,10 @@ func NewDb(path string) (*Db, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = migrate(db)
+	if err != nil {
+		return nil, err
+	}
 
 	own_info, _ := extructOwnInfo(db)
 
@@ -68,6 +75,10 @@ func NewDb(path string) (*Db, error) {
 	return res, nil
 }
 
+func (d *Db) Close() error {
+	return d.db.Close()
+}
+
 func (d *Db) GetOwnInfo() UserLightInfo {
 	return d.own_info
 }
@@ -88,9 +99,116 @@ func (d *Db) SetOwnUid(uid Uid) error {
 		d.own_info.Uid)
 }
 
-func (d *Db) SaveNewChat(cid Cid, name string, participants []Uid) error {
-	return d.doQuery(`INSERT INTO chat (cid, uids, name, group_flag, last_event_time) VALUES(?, ?, ?, 0, ?)`, 
-		cid, JoinUids(participants, ","), name, time.Now().UnixMicro())
+// ChangeOwnUid replaces own uid everywhere in db. It is used once to move
+// from random uid of old versions to the one derived from identity key.
+func (d *Db) ChangeOwnUid(uid Uid) error {
+	old := d.own_info.Uid
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = changeUid(tx, old, uid)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	d.own_info.Uid = uid
+	return nil
+}
+
+func changeUid(tx *sql.Tx, old, uid Uid) error {
+	for _, query := range []string{
+		`UPDATE main SET own_cid = ? WHERE own_cid = ?`,
+		`UPDATE user SET uid = ? WHERE uid = ?`,
+		`UPDATE message SET uid = ? WHERE uid = ?`,
+	} {
+		_, err := tx.Exec(query, uid, old)
+		if err != nil {
+			return err
+		}
+	}
+
+	rows, err := tx.Query(`SELECT cid, uids FROM chat`)
+	if err != nil {
+		return err
+	}
+	updated := make(map[Cid]string)
+	for rows.Next() {
+		var cid Cid
+		var uids string
+		err = rows.Scan(&cid, &uids)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		list := strings.Split(uids, ",")
+		for i := range list {
+			if list[i] == string(old) {
+				list[i] = string(uid)
+				updated[cid] = strings.Join(list, ",")
+			}
+		}
+	}
+	rows.Close()
+	for cid, uids := range updated {
+		_, err = tx.Exec(`UPDATE chat SET uids = ? WHERE cid = ?`, uids, cid)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *Db) SaveNewChat(cid Cid, name string, participants []Uid, key []byte) error {
+	sealed_name, err := d.sealText(name)
+	if err != nil {
+		return err
+	}
+	sealed_key, err := d.seal(key)
+	if err != nil {
+		return err
+	}
+	return d.doQuery(`INSERT INTO chat (cid, uids, name, group_flag, last_event_time, chat_key) VALUES(?, ?, ?, 0, ?, ?)`,
+		cid, JoinUids(participants, ","), sealed_name, time.Now().UnixMicro(), sealed_key)
+}
+
+// GetChatKey returns nil key if chat is unknown or was created before chats
+// had keys.
+func (d *Db) GetChatKey(cid Cid) ([]byte, error) {
+	var key []byte
+	err := d.db.QueryRow(`SELECT chat_key FROM chat WHERE cid = ?`, cid).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.open(key)
+}
+
+// GetSecret returns nil if there is no secret with such name.
+func (d *Db) GetSecret(name string) ([]byte, error) {
+	var value []byte
+	err := d.db.QueryRow(`SELECT value FROM secret WHERE name = ?`, name).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d.open(value)
+}
+
+func (d *Db) SetSecret(name string, value []byte) error {
+	sealed, err := d.seal(value)
+	if err != nil {
+		return err
+	}
+	return d.doQuery(`INSERT OR REPLACE INTO secret (name, value) VALUES (?, ?)`, name, sealed)
 }
 
 func (d *Db) AddParticipantToChat(cid Cid, participant Uid) error {
@@ -101,6 +219,7 @@ func (d *Db) AddParticipantToChat(cid Cid, participant Uid) error {
 	row.Next()
 	var participats Uid
 	err = row.Scan(&participats)
+	row.Close()
 	if err != nil {
 		return err
 	}
@@ -114,6 +233,203 @@ func (d *Db) SaveNewUid(uid Uid, name string, endpoints string) error {
 		uid, name, endpoints)
 }
 
+// GetIdentityKey returns key pinned for the user, nil if there is none yet.
+func (d *Db) GetIdentityKey(uid Uid) ([]byte, error) {
+	var key []byte
+	err := d.db.QueryRow(`SELECT identity_key FROM user WHERE uid = ?`, uid).Scan(&key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return key, err
+}
+
+// PinIdentityKey does nothing for users that are not saved yet. New key
+// drops verified flag.
+func (d *Db) PinIdentityKey(uid Uid, key []byte) error {
+	return d.doQuery(`UPDATE user SET verified = CASE WHEN identity_key = ? THEN verified ELSE 0 END,
+      identity_key = ? WHERE uid = ?`, key, key, uid)
+}
+
+func (d *Db) SetVerified(uid Uid, verified bool) error {
+	return d.doQuery(`UPDATE user SET verified = ? WHERE uid = ?`, verified, uid)
+}
+
+func (d *Db) GetVerifiedUids() (map[Uid]bool, error) {
+	rows, err := d.doSelect(`SELECT uid FROM user WHERE verified != 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make(map[Uid]bool)
+	for rows.Next() {
+		var uid Uid
+		err = rows.Scan(&uid)
+		if err != nil {
+			return nil, err
+		}
+		res[uid] = true
+	}
+	return res, nil
+}
+
+func (d *Db) AddPendingInvite(cid Cid, uid Uid, expires time.Time) error {
+	return d.doQuery(`INSERT OR REPLACE INTO pending_invite (cid, uid, expires) VALUES (?, ?, ?)`,
+		cid, uid, expires.UnixMicro())
+}
+
+// TakePendingInvite removes invite of uid to cid and returns true if it was
+// not expired. Expired invites are cleaned up on the way.
+func (d *Db) TakePendingInvite(cid Cid, uid Uid, now time.Time) (bool, error) {
+	err := d.doQuery(`DELETE FROM pending_invite WHERE expires < ?`, now.UnixMicro())
+	if err != nil {
+		return false, err
+	}
+	res, err := d.db.Exec(`DELETE FROM pending_invite WHERE cid = ? AND uid = ?`, cid, uid)
+	if err != nil {
+		return false, err
+	}
+	count, err := res.RowsAffected()
+	return count != 0, err
+}
+
+func (d *Db) SaveIncomingInvite(invite IncomingInvite, key []byte) error {
+	name, err := d.sealText(invite.Chat.Name)
+	if err != nil {
+		return err
+	}
+	sealed_key, err := d.seal(key)
+	if err != nil {
+		return err
+	}
+	return d.doQuery(`INSERT OR REPLACE INTO incoming_invite (cid, from_uid, uids, name, group_flag, chat_key, received)
+      VALUES (?, ?, ?, ?, ?, ?, ?)`, invite.Chat.Cid, invite.From, JoinUids(invite.Chat.Participants, ","),
+		name, invite.Chat.Group, sealed_key, time.Now().UnixMicro())
+}
+
+// GetIncomingInvite returns invite to chat cid and the chat key from it.
+func (d *Db) GetIncomingInvite(cid Cid) (IncomingInvite, []byte, error) {
+	rows, err := d.doSelect(`SELECT from_uid, cid, uids, name, group_flag, chat_key FROM incoming_invite WHERE cid = ?`, cid)
+	if err != nil {
+		return IncomingInvite{}, nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return IncomingInvite{}, nil, fmt.Errorf("No invite to chat %s", cid)
+	}
+	return d.scanIncomingInvite(rows)
+}
+
+func (d *Db) GetIncomingInvites() ([]IncomingInvite, error) {
+	rows, err := d.doSelect(`SELECT from_uid, cid, uids, name, group_flag, chat_key FROM incoming_invite ORDER BY received`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := make([]IncomingInvite, 0)
+	for rows.Next() {
+		invite, _, err := d.scanIncomingInvite(rows)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, invite)
+	}
+	return res, nil
+}
+
+func (d *Db) DeleteIncomingInvite(cid Cid) error {
+	return d.doQuery(`DELETE FROM incoming_invite WHERE cid = ?`, cid)
+}
+
+// DeleteChat removes the chat together with its messages.
+func (d *Db) DeleteChat(cid Cid) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		`DELETE FROM message WHERE cid = ?`,
+		`DELETE FROM chat WHERE cid = ?`,
+	} {
+		_, err = tx.Exec(query, cid)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (d *Db) SetBlocked(uid Uid, blocked bool) error {
+	return d.doQuery(`UPDATE user SET blocked = ? WHERE uid = ?`, blocked, uid)
+}
+
+func (d *Db) IsBlocked(uid Uid) bool {
+	var blocked bool
+	err := d.db.QueryRow(`SELECT blocked FROM user WHERE uid = ?`, uid).Scan(&blocked)
+	return err == nil && blocked
+}
+
+// GetUidsByName returns uids of other users with the name. Users choose
+// names themselves, so there may be several.
+func (d *Db) GetUidsByName(name string) ([]Uid, error) {
+	rows, err := d.doSelect(`SELECT uid FROM user WHERE name = ? AND uid != ?`, name, d.own_info.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUids(rows)
+}
+
+func scanUids(rows *sql.Rows) ([]Uid, error) {
+	res := make([]Uid, 0, 1)
+	for rows.Next() {
+		var uid Uid
+		err := rows.Scan(&uid)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, uid)
+	}
+	return res, nil
+}
+
+// FindUid returns uid of the other user with the name or, if there is no
+// such name, with uid starting with the query. It fails if several users
+// match, since names are not unique.
+func (d *Db) FindUid(query string) (Uid, error) {
+	uids, err := d.GetUidsByName(query)
+	if err != nil {
+		return "", err
+	}
+	if len(uids) == 0 {
+		uids, err = d.getUidsByPrefix(query)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch len(uids) {
+	case 0:
+		return "", fmt.Errorf("Unknown user %s", query)
+	case 1:
+		return uids[0], nil
+	default:
+		return "", fmt.Errorf("%d users match %s, use uid (prefix) of one: %s", len(uids), query, JoinUids(uids, ", "))
+	}
+}
+
+func (d *Db) getUidsByPrefix(prefix string) ([]Uid, error) {
+	if prefix == "" {
+		return nil, nil
+	}
+	rows, err := d.doSelect(`SELECT uid FROM user WHERE substr(uid, 1, ?) = ? AND uid != ?`,
+		len(prefix), prefix, d.own_info.Uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanUids(rows)
+}
+
 func (d *Db) IsKnownUid(uid Uid) bool {
 	rows, err := d.doSelect("SELECT uid FROM user WHERE uid = ?", uid)
 	if err != nil {
@@ -125,8 +441,12 @@ func (d *Db) IsKnownUid(uid Uid) bool {
 }
 
 func (d *Db) SaveMessage(msg ChatMessage) error {
-	err := d.doQuery(`INSERT INTO message (uid, msg_index, cid, msg)
-      VALUES(?, ?, ?, ?)`, msg.Uid, msg.Index, msg.Cid, msg.Text)
+	text, err := d.sealText(msg.Text)
+	if err != nil {
+		return err
+	}
+	err = d.doQuery(`INSERT INTO message (uid, msg_index, cid, msg, sealed, signature, author_key)
+      VALUES(?, ?, ?, ?, ?, ?, ?)`, msg.Uid, msg.Index, msg.Cid, text, msg.Sealed, msg.Signature, msg.AuthorKey)
 	if err != nil {
 		return err
 	}
@@ -137,7 +457,7 @@ func (d *Db) GetMessages(cid Cid, from_index, to_index uint32) ([]ChatMessage, e
 	if cid == "" {
 		return nil, errors.New("cannot have empty cid")
 	}
-	stmt, err := d.db.Prepare(`SELECT uid, msg_index, cid, msg FROM message 
+	stmt, err := d.db.Prepare(`SELECT uid, msg_index, cid, msg, sealed, signature, author_key FROM message
       WHERE cid = ? AND msg_index >= ? AND msg_index <= ?`)
 	if err != nil {
 		return nil, err
@@ -153,8 +473,7 @@ func (d *Db) GetMessages(cid Cid, from_index, to_index uint32) ([]ChatMessage, e
 	res := make([]ChatMessage, 0, 10)
 
 	for rows.Next() {
-		var msg ChatMessage
-		err = rows.Scan(&msg.Uid, &msg.Index, &msg.Cid, &msg.Text)
+		msg, err := d.scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -197,17 +516,10 @@ func (d *Db) GetChats(sorted bool) ([]ChatInfo, error) {
 	res := make([]ChatInfo, 0, 10)
 
 	for rows.Next() {
-		var info ChatInfo
-		var participants string
-		var group int
-		err = rows.Scan(&info.Cid, &participants, &info.Name, &group)
+		info, err := d.scanChatInfo(rows)
 		if err != nil {
 			return nil, err
 		}
-		if group != 0 {
-			info.Group = true
-		}
-		info.Participants = SplitUids(participants, ",")
 		res = append(res, info)
 	}
 	return res, nil
@@ -221,17 +533,10 @@ func (d *Db) GetChatInfo(cid Cid) (*ChatInfo, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var info ChatInfo
-		var participants string
-		var group int
-		err = rows.Scan(&info.Cid, &participants, &info.Name, &group)
+		info, err := d.scanChatInfo(rows)
 		if err != nil {
 			return nil, err
 		}
-		if group != 0 {
-			info.Group = true
-		}
-		info.Participants = SplitUids(participants, ",")
 		return &info, nil
 	}
 	return nil, nil
@@ -362,7 +667,7 @@ func (d *Db) GetVectorClockOfCids(cids []Cid) (map[Cid]VectorClock, error) {
 
 
 func (d *Db) GetMessagesByVectorClock(vc map[Cid]VectorClock) ([]ChatMessage, error) {
-	template := `SELECT uid, msg_index, cid, msg FROM message WHERE cid = "%s" AND uid = "%s" AND msg_index > %d`
+	template := `SELECT uid, msg_index, cid, msg, sealed, signature, author_key FROM message WHERE cid = "%s" AND uid = "%s" AND msg_index > %d`
 	query := ""
 	first := true
 	for cid, vector := range vc {
@@ -384,8 +689,7 @@ func (d *Db) GetMessagesByVectorClock(vc map[Cid]VectorClock) ([]ChatMessage, er
 	result := make([]ChatMessage, 0, 20)
 
 	for rows.Next() {
-		var msg ChatMessage
-		err = rows.Scan(&msg.Uid, &msg.Index, &msg.Cid, &msg.Text)
+		msg, err := d.scanMessage(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -393,3 +697,136 @@ func (d *Db) GetMessagesByVectorClock(vc map[Cid]VectorClock) ([]ChatMessage, er
 	}
 	return result, nil
 }
+
+// scanMessage reads row of SELECT uid, msg_index, cid, msg, sealed,
+// signature, author_key.
+func (d *Db) scanMessage(rows *sql.Rows) (ChatMessage, error) {
+	var msg ChatMessage
+	var text []byte
+	err := rows.Scan(&msg.Uid, &msg.Index, &msg.Cid, &text, &msg.Sealed, &msg.Signature, &msg.AuthorKey)
+	if err != nil {
+		return msg, err
+	}
+	msg.Text, err = d.openText(text)
+	return msg, err
+}
+
+// scanIncomingInvite reads row of SELECT from_uid, cid, uids, name,
+// group_flag, chat_key.
+func (d *Db) scanIncomingInvite(rows *sql.Rows) (IncomingInvite, []byte, error) {
+	var invite IncomingInvite
+	var participants string
+	var name, key []byte
+	err := rows.Scan(&invite.From, &invite.Chat.Cid, &participants, &name, &invite.Chat.Group, &key)
+	if err != nil {
+		return invite, nil, err
+	}
+	invite.Chat.Participants = SplitUids(participants, ",")
+	invite.Chat.Name, err = d.openText(name)
+	if err != nil {
+		return invite, nil, err
+	}
+	key, err = d.open(key)
+	return invite, key, err
+}
+
+// scanChatInfo reads row of SELECT cid, uids, name, group_flag.
+func (d *Db) scanChatInfo(rows *sql.Rows) (ChatInfo, error) {
+	var info ChatInfo
+	var participants string
+	var name []byte
+	var group int
+	err := rows.Scan(&info.Cid, &participants, &name, &group)
+	if err != nil {
+		return info, err
+	}
+	info.Name, err = d.openText(name)
+	if err != nil {
+		return info, err
+	}
+	if group != 0 {
+		info.Group = true
+	}
+	info.Participants = SplitUids(participants, ",")
+	return info, nil
+}
+
+// migrations[i] brings schema from version i to i+1. Version is kept in
+// sqlite user_version pragma.
+var migrations = []string{
+	`
+		CREATE TABLE secret (
+		  name  TEXT PRIMARY KEY,
+		  value BLOB
+		);
+		ALTER TABLE chat ADD COLUMN chat_key BLOB;
+		ALTER TABLE message ADD COLUMN sealed BLOB;
+	`,
+	`
+		ALTER TABLE message ADD COLUMN signature BLOB;
+		ALTER TABLE message ADD COLUMN author_key BLOB;
+	`,
+	`
+		ALTER TABLE user ADD COLUMN identity_key BLOB;
+	`,
+	`
+		ALTER TABLE user ADD COLUMN verified INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		CREATE TABLE crypt (
+		  salt        BLOB,
+		  check_value BLOB
+		);
+	`,
+	`
+		ALTER TABLE user ADD COLUMN blocked INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		CREATE TABLE pending_invite (
+		  cid     TEXT,
+		  uid     TEXT,
+		  expires INTEGER,
+		  PRIMARY KEY(cid, uid)
+		);
+	`,
+	`
+		CREATE TABLE incoming_invite (
+		  cid          TEXT PRIMARY KEY,
+		  from_uid     TEXT,
+		  uids         TEXT,
+		  name         TEXT,
+		  group_flag   INTEGER,
+		  chat_key     BLOB,
+		  received     INTEGER
+		);
+	`,
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Cannot migrate db to version %d: %w", version+1, err)
+		}
+		_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package glink
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -154,3 +155,138 @@ func TestVectorClock(t *testing.T) {
 	assert.Nil(err)
 	require.Equal(t, expected, vc)
 }
+
+func TestDbMigrationsKeepData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glink.db")
+	db, err := NewDb(path)
+	require.Nil(t, err)
+	require.Nil(t, db.SetSecret("name", []byte("value")))
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{"uid"}, []byte("key")))
+
+	// Reopening must not run migrations again.
+	db, err = NewDb(path)
+	require.Nil(t, err)
+	secret, err := db.GetSecret("name")
+	require.Nil(t, err)
+	require.Equal(t, []byte("value"), secret)
+	key, err := db.GetChatKey("cid")
+	require.Nil(t, err)
+	require.Equal(t, []byte("key"), key)
+
+	secret, err = db.GetSecret("unknown")
+	require.Nil(t, err)
+	require.Nil(t, secret)
+}
+
+func TestDbChangeOwnUid(t *testing.T) {
+	db, err := NewDb(filepath.Join(t.TempDir(), "glink.db"))
+	require.Nil(t, err)
+	require.Nil(t, db.SetOwnUid("old"))
+	require.Nil(t, db.SetOwnName("me"))
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{"old"}, nil))
+	require.Nil(t, db.AddParticipantToChat("cid", "peer"))
+	require.Nil(t, db.SaveMessage(ChatMessage{Uid: "old", Cid: "cid", Index: 1}))
+
+	require.Nil(t, db.ChangeOwnUid("new"))
+	require.Equal(t, Uid("new"), db.GetOwnInfo().Uid)
+	name, err := db.GetNameByUid("new")
+	require.Nil(t, err)
+	require.Equal(t, "me", name)
+	msgs, err := db.GetMessages("cid", 0, 10)
+	require.Nil(t, err)
+	require.Equal(t, Uid("new"), msgs[0].Uid)
+	var uids string
+	require.Nil(t, db.db.QueryRow(`SELECT uids FROM chat WHERE cid = ?`, "cid").Scan(&uids))
+	require.Equal(t, "new,peer", uids)
+}
+
+func TestDbPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "glink.db")
+	db, err := NewDb(path)
+	require.Nil(t, err)
+	require.Nil(t, db.SetSecret("secret", []byte("key material")))
+	require.Nil(t, db.SaveNewChat("cid", "chat name", []Uid{"uid"}, []byte("chat key")))
+	require.Nil(t, db.SaveMessage(ChatMessage{Uid: "uid", Cid: "cid", Index: 1, Text: "old plain text"}))
+
+	require.Nil(t, db.ChangePassphrase("passphrase"))
+	for _, query := range []string{
+		`SELECT value FROM secret`,
+		`SELECT name FROM chat`,
+		`SELECT chat_key FROM chat`,
+		`SELECT msg FROM message`,
+	} {
+		var raw []byte
+		require.Nil(t, db.db.QueryRow(query).Scan(&raw))
+		for _, plain := range []string{"key material", "chat name", "chat key", "old plain text"} {
+			require.NotContains(t, string(raw), plain, query)
+		}
+	}
+
+	db, err = NewDb(path)
+	require.Nil(t, err)
+	require.True(t, db.IsEncrypted())
+	require.ErrorIs(t, db.Unlock("wrong"), ErrWrongPassphrase)
+	require.Nil(t, db.Unlock("passphrase"))
+	secret, err := db.GetSecret("secret")
+	require.Nil(t, err)
+	require.Equal(t, []byte("key material"), secret)
+	info, err := db.GetChatInfo("cid")
+	require.Nil(t, err)
+	require.Equal(t, "chat name", info.Name)
+	require.Nil(t, db.SaveMessage(ChatMessage{Uid: "uid", Cid: "cid", Index: 2, Text: "new text"}))
+	msgs, err := db.GetMessages("cid", 0, 10)
+	require.Nil(t, err)
+	require.Equal(t, "old plain text", msgs[0].Text)
+	require.Equal(t, "new text", msgs[1].Text)
+
+	require.Nil(t, db.ChangePassphrase(""))
+	db, err = NewDb(path)
+	require.Nil(t, err)
+	require.False(t, db.IsEncrypted())
+	key, err := db.GetChatKey("cid")
+	require.Nil(t, err)
+	require.Equal(t, []byte("chat key"), key)
+}
+
+func TestDbFindUid(t *testing.T) {
+	db, err := NewDb("")
+	require.Nil(t, err)
+	require.Nil(t, db.SetOwnUid("ab00"))
+	require.Nil(t, db.SetOwnName("me"))
+	require.Nil(t, db.SaveNewUid("ab12", "alice", ""))
+	require.Nil(t, db.SaveNewUid("ab34", "alice", ""))
+	require.Nil(t, db.SaveNewUid("cd56", "carol", ""))
+
+	for query, want := range map[string]Uid{"carol": "cd56", "ab1": "ab12", "ab34": "ab34", "c": "cd56"} {
+		uid, err := db.FindUid(query)
+		require.Nil(t, err, query)
+		require.Equal(t, want, uid, query)
+	}
+	for _, query := range []string{"alice", "ab", "me", "ab00", "bob", ""} {
+		_, err := db.FindUid(query)
+		require.NotNil(t, err, query)
+	}
+}
+
+func TestDbPassphraseLeavesNoPlaintextInFile(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(filepath.Join(dir, "glink.db"))
+	require.Nil(t, err)
+	require.Nil(t, db.SetSecret("secret", []byte("key material")))
+	require.Nil(t, db.SaveNewChat("cid", "chat name", []Uid{"uid"}, []byte("chat key")))
+	for i := 1; i <= 100; i++ {
+		require.Nil(t, db.SaveMessage(ChatMessage{Uid: "uid", Cid: "cid", Index: uint32(i), Text: "old plain text"}))
+	}
+
+	require.Nil(t, db.ChangePassphrase("passphrase"))
+	require.Nil(t, db.db.Close())
+	files, err := os.ReadDir(dir)
+	require.Nil(t, err)
+	for _, file := range files {
+		raw, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		require.Nil(t, err)
+		for _, plain := range []string{"key material", "chat name", "chat key", "old plain text"} {
+			require.NotContains(t, string(raw), plain, file.Name())
+		}
+	}
+}
@@ -1,116 +1,398 @@
 package glink
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/juju/loggo"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	BackendMulticast = "multicast"
+	BackendMdns      = "mdns"
+	BackendStatic    = "static"
 )
 
 const (
-	srvAddr         = "224.0.0.1:9999"
 	maxDatagramSize = 8192
+	// sweepInterval is how often discovery looks for lost nodes when
+	// there are no announces.
+	sweepInterval = time.Second
 )
 
-var knownNodes = &sync.Map{}
+type DiscoveryConfig struct {
+	// Backend is comma separated list of ways to find other nodes, see
+	// Discovery, MdnsDiscovery and StaticDiscovery.
+	Backend string
+	// Group is IPv4 or IPv6 multicast address announces are sent to. Nodes
+	// see each other only if they use the same Group and Port.
+	Group string
+	Port  int
+	// Interface is the name of network interface to send and listen
+	// announces on. Empty string lets the system choose.
+	Interface string
+	// TTL (hop limit for IPv6) of announces, 1 keeps them in local network.
+	TTL int
+	// Node that sent no announces for NodeTimeout is reported lost.
+	// Announces are sent every second.
+	NodeTimeout time.Duration
+	// StaticPeers are host:port endpoints StaticDiscovery connects to.
+	StaticPeers []string
+}
+
+func DefaultDiscoveryConfig() DiscoveryConfig {
+	return DiscoveryConfig{
+		Backend:     BackendMulticast,
+		Group:       "224.0.0.1",
+		Port:        9999,
+		TTL:         1,
+		NodeTimeout: 5 * time.Second,
+	}
+}
+
+// resolve returns multicast group address and interface, nil if it is not
+// set.
+func (c DiscoveryConfig) resolve() (*net.UDPAddr, *net.Interface, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(c.Group, strconv.Itoa(c.Port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, nil, fmt.Errorf("%s is not a multicast address", c.Group)
+	}
+	iface, err := c.iface()
+	if err != nil {
+		return nil, nil, err
+	}
+	if iface != nil && addr.IP.IsLinkLocalMulticast() && addr.IP.To4() == nil {
+		addr.Zone = iface.Name
+	}
+	return addr, iface, nil
+}
+
+// iface returns configured network interface or nil if it is not set.
+func (c DiscoveryConfig) iface() (*net.Interface, error) {
+	if c.Interface == "" {
+		return nil, nil
+	}
+	iface, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot find interface %s: %w", c.Interface, err)
+	}
+	return iface, nil
+}
 
 type DiscoveryInfo struct {
 	ClientId   Uid
 	ClientName string
 	Endpoint   string
+	PublicKey  []byte
+	Signature  []byte
+	// Source is the backend that found the node.
+	Source string
+	// Sources are all backends that see the node, sorted. Only MultiDiscovery
+	// sets them, see Backends.
+	Sources []string
+}
+
+// Backends returns names of backends that see the node.
+func (i DiscoveryInfo) Backends() []string {
+	if len(i.Sources) == 0 {
+		return []string{i.Source}
+	}
+	return i.Sources
+}
+
+// Announce returns signed NodeAnnounce the info was made from.
+func (i DiscoveryInfo) Announce() NodeAnnounce {
+	return NodeAnnounce{Uid: i.ClientId, Name: i.ClientName, Endpoint: i.Endpoint, PublicKey: i.PublicKey, Signature: i.Signature}
+}
+
+func discoveryInfo(msg NodeAnnounce) DiscoveryInfo {
+	return DiscoveryInfo{
+		ClientId:   msg.Uid,
+		ClientName: msg.Name,
+		Endpoint:   msg.Endpoint,
+		PublicKey:  msg.PublicKey,
+		Signature:  msg.Signature,
+	}
+}
+
+// NodeChanged is sent when node announces other endpoint or name.
+type NodeChanged struct {
+	Info DiscoveryInfo
+	Old  DiscoveryInfo
 }
 
+// NodeLost is sent when node has not announced itself for NodeTimeout.
+type NodeLost struct {
+	Uid    Uid
+	Name   string
+	Source string
+}
+
+// IDiscovery sends DiscoveryInfo for every new node to the event channel,
+// then NodeChanged and NodeLost about it.
 type IDiscovery interface {
-	Run(eventChan chan DiscoveryInfo) error
+	Run(eventChan chan interface{}) error
 	Close()
 }
 
+// nodeTracker remembers when nodes were seen last time. It is used only by
+// the discovery read loop, so needs no locking.
+type nodeTracker struct {
+	timeout time.Duration
+	nodes   map[Uid]*trackedNode
+}
+
+type trackedNode struct {
+	info     DiscoveryInfo
+	lastSeen time.Time
+}
+
+func newNodeTracker(timeout time.Duration) *nodeTracker {
+	return &nodeTracker{timeout: timeout, nodes: make(map[Uid]*trackedNode)}
+}
+
+// seen returns event about the node or nil if nothing has changed.
+func (t *nodeTracker) seen(info DiscoveryInfo, now time.Time) interface{} {
+	node, ok := t.nodes[info.ClientId]
+	if !ok {
+		t.nodes[info.ClientId] = &trackedNode{info: info, lastSeen: now}
+		return info
+	}
+	node.lastSeen = now
+	if node.info.Endpoint == info.Endpoint && node.info.ClientName == info.ClientName {
+		return nil
+	}
+	old := node.info
+	node.info = info
+	return NodeChanged{Info: info, Old: old}
+}
+
+// expire forgets nodes not seen for timeout.
+func (t *nodeTracker) expire(now time.Time) []NodeLost {
+	var lost []NodeLost
+	for uid, node := range t.nodes {
+		if now.Sub(node.lastSeen) > t.timeout {
+			delete(t.nodes, uid)
+			lost = append(lost, NodeLost{Uid: uid, Name: node.info.ClientName, Source: node.info.Source})
+		}
+	}
+	return lost
+}
+
+// NewDiscoveryBackend creates IDiscovery chosen by config.Backend. Several
+// comma separated backends run together, see MultiDiscovery.
+func NewDiscoveryBackend(own_info NodeAnnounce, config DiscoveryConfig, log *loggo.Logger) (IDiscovery, error) {
+	names := strings.Split(config.Backend, ",")
+	if len(names) == 1 {
+		return newBackend(names[0], own_info, config, log)
+	}
+	backends := make([]IDiscovery, 0, len(names))
+	for _, name := range names {
+		backend, err := newBackend(name, own_info, config, log)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, backend)
+	}
+	return NewMultiDiscovery(backends...), nil
+}
+
+func newBackend(name string, own_info NodeAnnounce, config DiscoveryConfig, log *loggo.Logger) (IDiscovery, error) {
+	switch strings.TrimSpace(name) {
+	case BackendMulticast:
+		return NewDiscovery(own_info, config, log), nil
+	case BackendMdns:
+		return NewMdnsDiscovery(own_info, config, log), nil
+	case BackendStatic:
+		return NewStaticDiscovery(config.StaticPeers), nil
+	default:
+		return nil, fmt.Errorf("Unknown discovery backend %q", name)
+	}
+}
+
 type Discovery struct {
-	NewNodes chan DiscoveryInfo
+	NewNodes chan interface{}
 	OwnInfo  NodeAnnounce
+	config   DiscoveryConfig
 	log      *loggo.Logger
+	listener *net.UDPConn
+	sender   net.PacketConn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
 }
 
-func NewDiscovery(own_info NodeAnnounce, log *loggo.Logger) *Discovery {
-	return &Discovery{OwnInfo: own_info, log: log}
+func NewDiscovery(own_info NodeAnnounce, config DiscoveryConfig, log *loggo.Logger) *Discovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Discovery{OwnInfo: own_info, config: config, log: log, ctx: ctx, cancel: cancel}
 }
 
-func (d *Discovery) Run(eventChan chan DiscoveryInfo) error {
+func (d *Discovery) Run(eventChan chan interface{}) error {
 	d.NewNodes = eventChan
-	err := d.serve()
+	group, iface, err := d.config.resolve()
 	if err != nil {
-		return err
+		return fmt.Errorf("Bad discovery config: %w", err)
 	}
-	go d.ping()
+	listener, err := net.ListenMulticastUDP(udpNetwork(group), iface, group)
+	if err != nil {
+		return fmt.Errorf("Cannot listen multicast: %s", err)
+	}
+	sender, err := d.dialGroup(group, iface)
+	if err != nil {
+		listener.Close()
+		return fmt.Errorf("Cannot send to multicast group %s: %w", group, err)
+	}
+	d.listener, d.sender = listener, sender
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.serve()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.ping(group)
+	}()
 	return nil
 }
 
-func (*Discovery) Close() {
+// Close stops announces and returns when discovery goroutines are done.
+func (d *Discovery) Close() {
+	d.cancel()
+	if d.listener != nil {
+		d.listener.Close()
+		d.sender.Close()
+	}
+	d.wg.Wait()
+}
 
+// emit passes event to the service unless discovery is closed.
+func (d *Discovery) emit(ev interface{}) {
+	select {
+	case d.NewNodes <- ev:
+	case <-d.ctx.Done():
+	}
 }
 
-func (d *Discovery) serve() error {
-	addr, err := net.ResolveUDPAddr("udp", srvAddr)
-	if err != nil {
-		return err
+func (d *Discovery) serve() {
+	l := d.listener
+	l.SetReadBuffer(maxDatagramSize)
+	tracker := newNodeTracker(d.config.NodeTimeout)
+	for d.ctx.Err() == nil {
+		for _, lost := range tracker.expire(time.Now()) {
+			d.emit(lost)
+		}
+		buffer := make([]byte, maxDatagramSize)
+		l.SetReadDeadline(time.Now().Add(sweepInterval))
+		n, src, err := l.ReadFromUDP(buffer)
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			continue
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || n == 0 {
+			d.log.Errorf("ReadFromUDP failed: %v", err)
+			continue
+		}
+
+		reader := NewFrameReader(bytes.NewReader(buffer[:n]), maxDatagramSize)
+		_, payload, err := reader.ReadFrame()
+		if err != nil {
+			d.log.Errorf("Cannot read announce from %s: %s", src, err)
+			continue
+		}
+
+		msg, err := DecodeMsg[NodeAnnounce](payload)
+		if err != nil {
+			d.log.Errorf("Cannot decode announce from %s: %s", src, err)
+			continue
+		}
+		err = VerifyAnnounce(msg)
+		if err != nil {
+			d.log.Warningf("Drop announce from %s: %s", src, err)
+			continue
+		}
+
+		info := discoveryInfo(msg)
+		info.Source = BackendMulticast
+		if ev := tracker.seen(info, time.Now()); ev != nil {
+			d.emit(ev)
+		}
 	}
+}
 
-	l, err := net.ListenMulticastUDP("udp", nil, addr)
+// dialGroup returns socket for sending announces with configured TTL and
+// interface. Loopback is on, so nodes on the same host see each other.
+func (d *Discovery) dialGroup(group *net.UDPAddr, iface *net.Interface) (net.PacketConn, error) {
+	c, err := net.ListenPacket(udpNetwork(group), ":0")
 	if err != nil {
-		return fmt.Errorf("Cannot listen multicast: %s", err)
+		return nil, err
 	}
-
-	go func() {
-		l.SetReadBuffer(maxDatagramSize)
-		for {
-			buffer := make([]byte, maxDatagramSize)
-			n, src, err := l.ReadFromUDP(buffer)
-			if err != nil || n == 0 {
-				d.log.Errorf("ReadFromUDP failed:", err)
-				continue
-			}
-
-			hdr, err := DecodeHeader(buffer)
-			if err != nil {
-				d.log.Errorf("Cannot decode header:", err)
-				continue
-			}
-
-			payload := buffer[6 : 6+hdr.PayloadSize]
-			msg, err := DecodeMsg[NodeAnnounce](payload)
-			if err != nil {
-				d.log.Errorf("Cannot decode payload:", payload)
-				continue
-			}
-
-			if _, has := knownNodes.Load(src.String()); !has {
-				knownNodes.Store(src.String(), nil)
-				d.NewNodes <- DiscoveryInfo{ClientId: msg.Uid, ClientName: msg.Name, Endpoint: msg.Endpoint}
-			}
+	if group.IP.To4() != nil {
+		p := ipv4.NewPacketConn(c)
+		err = p.SetMulticastTTL(d.config.TTL)
+		if err == nil && iface != nil {
+			err = p.SetMulticastInterface(iface)
 		}
-	}()
-	return nil
+		if err == nil {
+			err = p.SetMulticastLoopback(true)
+		}
+	} else {
+		p := ipv6.NewPacketConn(c)
+		err = p.SetMulticastHopLimit(d.config.TTL)
+		if err == nil && iface != nil {
+			err = p.SetMulticastInterface(iface)
+		}
+		if err == nil {
+			err = p.SetMulticastLoopback(true)
+		}
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-func (d *Discovery) ping() {
-	addr, err := net.ResolveUDPAddr("udp", srvAddr)
-	if err != nil {
-		d.log.Errorf("%w", err)
+func udpNetwork(addr *net.UDPAddr) string {
+	if addr.IP.To4() != nil {
+		return "udp4"
 	}
-	c, err := net.DialUDP("udp", nil, addr)
+	return "udp6"
+}
+
+func (d *Discovery) ping(group *net.UDPAddr) {
 	msg, err := EncodeMsg(d.OwnInfo)
 	if err != nil {
-		d.log.Errorf("Cannot encode ping message", err)
+		d.log.Errorf("Cannot encode ping message: %s", err)
+		return
 	}
 
-	merged := append(msg.Header, msg.Payload...)
+	merged := EncodeFrame(msg)
 
-	d.log.Tracef("Start sending discovery info")
+	d.log.Tracef("Start sending discovery info to %s", group)
 
 	for {
-		c.Write(merged)
-		time.Sleep(1 * time.Second)
+		_, err = d.sender.WriteTo(merged, group)
+		if err != nil && d.ctx.Err() == nil {
+			d.log.Debugf("Cannot send discovery info: %s", err)
+		}
+		select {
+		case <-time.After(1 * time.Second):
+		case <-d.ctx.Done():
+			return
+		}
 	}
 }
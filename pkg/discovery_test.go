@@ -0,0 +1,137 @@
+package glink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiscoveryConfigResolve(t *testing.T) {
+	config := DefaultDiscoveryConfig()
+	group, iface, err := config.resolve()
+	require.Nil(t, err)
+	require.Equal(t, "224.0.0.1:9999", group.String())
+	require.Nil(t, iface)
+
+	config.Group = "ff02::1"
+	config.Port = 10000
+	group, _, err = config.resolve()
+	require.Nil(t, err)
+	require.Equal(t, "[ff02::1]:10000", group.String())
+	require.Equal(t, "udp6", udpNetwork(group))
+
+	config.Group = "192.168.0.1"
+	_, _, err = config.resolve()
+	require.NotNil(t, err)
+
+	config = DefaultDiscoveryConfig()
+	config.Interface = "no-such-interface"
+	_, _, err = config.resolve()
+	require.NotNil(t, err)
+}
+
+func TestNodeTracker(t *testing.T) {
+	now := time.Now()
+	tracker := newNodeTracker(5 * time.Second)
+	alice := DiscoveryInfo{ClientId: "alice", ClientName: "alice", Endpoint: "10.0.0.1:1"}
+	require.Equal(t, alice, tracker.seen(alice, now))
+	require.Nil(t, tracker.seen(alice, now.Add(time.Second)))
+
+	moved := alice
+	moved.Endpoint = "10.0.0.2:1"
+	require.Equal(t, NodeChanged{Info: moved, Old: alice}, tracker.seen(moved, now.Add(2*time.Second)))
+
+	require.Empty(t, tracker.expire(now.Add(6*time.Second)))
+	require.Equal(t, []NodeLost{{Uid: "alice", Name: "alice"}}, tracker.expire(now.Add(8*time.Second)))
+	require.Equal(t, moved, tracker.seen(moved, now.Add(9*time.Second)))
+}
+
+func TestMdnsTxtKeepsSignedAnnounce(t *testing.T) {
+	alice := newTestIdentity(t)
+	announce := alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+	txt := announceTxt(announce)
+	for _, record := range txt {
+		require.LessOrEqual(t, len(record), 255)
+	}
+	parsed, err := announceFromTxt(txt)
+	require.Nil(t, err)
+	require.Equal(t, announce, parsed)
+	require.Nil(t, VerifyAnnounce(parsed))
+
+	_, err = announceFromTxt([]string{"name=alice"})
+	require.NotNil(t, err)
+}
+
+func TestDiscoveryMergerDeduplicatesByUid(t *testing.T) {
+	merger := newDiscoveryMerger()
+	multicast := DiscoveryInfo{ClientId: "alice", ClientName: "alice", Endpoint: "10.0.0.1:1", Source: BackendMulticast}
+	mdns := multicast
+	mdns.Source = BackendMdns
+	first := multicast
+	first.Sources = []string{BackendMulticast}
+	require.Equal(t, []interface{}{first}, merger.merge(multicast))
+	require.Empty(t, merger.merge(multicast))
+	both := first
+	both.Sources = []string{BackendMdns, BackendMulticast}
+	require.Equal(t, []interface{}{NodeChanged{Info: both, Old: first}}, merger.merge(mdns))
+
+	// Only the first backend reports changes.
+	moved := mdns
+	moved.Endpoint = "10.0.0.2:1"
+	require.Empty(t, merger.merge(NodeChanged{Info: moved, Old: mdns}))
+
+	// Node stays while any backend sees it.
+	onlyMdns := moved
+	onlyMdns.Sources = []string{BackendMdns}
+	require.Equal(t, []interface{}{NodeChanged{Info: onlyMdns, Old: both}},
+		merger.merge(NodeLost{Uid: "alice", Name: "alice", Source: BackendMulticast}))
+	lost := NodeLost{Uid: "alice", Name: "alice", Source: BackendMdns}
+	require.Equal(t, []interface{}{lost}, merger.merge(lost))
+	require.Empty(t, merger.merge(lost))
+
+	// Backend that is not current drops the node, endpoint stays the same.
+	require.Equal(t, []interface{}{first}, merger.merge(multicast))
+	require.Len(t, merger.merge(mdns), 1)
+	require.Equal(t, []interface{}{NodeChanged{Info: first, Old: both}},
+		merger.merge(NodeLost{Uid: "alice", Name: "alice", Source: BackendMdns}))
+
+	// Current backend drops the node, the other one has the same endpoint.
+	require.Len(t, merger.merge(mdns), 1)
+	sameEndpoint := mdns
+	sameEndpoint.Sources = []string{BackendMdns}
+	require.Equal(t, []interface{}{NodeChanged{Info: sameEndpoint, Old: both}},
+		merger.merge(NodeLost{Uid: "alice", Name: "alice", Source: BackendMulticast}))
+
+	address := PeerAddress{Endpoint: "10.0.0.3:1"}
+	require.Equal(t, []interface{}{address}, merger.merge(address))
+}
+
+func TestDiscoveryCloseStopsGoroutines(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	alice := newTestIdentity(t)
+	config := DefaultDiscoveryConfig()
+	config.Port = 19999
+	config.Backend = BackendMulticast + "," + BackendStatic
+	config.StaticPeers = []string{"127.0.0.1:1"}
+	d, err := NewDiscoveryBackend(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"}), config, &logger)
+	require.Nil(t, err)
+	// Nobody reads events, backends get stuck on sending them.
+	err = d.Run(make(chan interface{}))
+	if err != nil {
+		t.Skipf("No multicast: %s", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close hangs")
+	}
+}
@@ -0,0 +1,104 @@
+package glink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Frame directions in DumpRecord
+const (
+	DumpIn  = "in"
+	DumpOut = "out"
+)
+
+// DumpRecord is one frame seen on the wire. Frame holds header and payload
+// exactly as they were sent, Peer is empty for handshake frames. Version is
+// protocol version of the frame layout.
+type DumpRecord struct {
+	Time    time.Time
+	Dir     string
+	Peer    Uid
+	Remote  string
+	Codec   string
+	Version uint16
+	Frame   []byte
+}
+
+// FrameDumper appends DumpRecords to a file as JSON lines.
+type FrameDumper struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+func NewFrameDumper(path string) (*FrameDumper, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot open dump file: %w", err)
+	}
+	return &FrameDumper{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Dump is safe to call on nil dumper, it does nothing then.
+func (d *FrameDumper) Dump(dir string, peer Uid, remote string, codec Codec, version uint16, frame []byte) {
+	if d == nil {
+		return
+	}
+	rec := DumpRecord{Time: time.Now(), Dir: dir, Peer: peer, Remote: remote, Codec: codec.Name(), Version: version, Frame: frame}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.enc.Encode(rec)
+}
+
+func (d *FrameDumper) Close() error {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.file.Close()
+}
+
+// ReadDump calls fn for every record in the dump.
+func ReadDump(r io.Reader, fn func(DumpRecord) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 2*DefaultMaxFrameSize)
+	for line := 1; scanner.Scan(); line++ {
+		var rec DumpRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			return fmt.Errorf("Cannot parse dump line %d: %w", line, err)
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Decode parses the frame the same way the server does.
+func (r DumpRecord) Decode() (MsgHeader, any, error) {
+	codec := CodecByName(r.Codec)
+	if codec == nil {
+		return MsgHeader{}, nil, fmt.Errorf("Unknown codec %s", r.Codec)
+	}
+	// Frame was accepted (or sent) by the server, so don't limit its size here.
+	reader := NewFrameReader(bytes.NewReader(r.Frame), ^uint32(0))
+	if r.Version != 0 {
+		// Older dumps have no version, all their frames have full header.
+		reader.Version = r.Version
+	}
+	hdr, payload, err := reader.ReadFrame()
+	if err != nil {
+		return hdr, nil, err
+	}
+	msg, err := registry.decode(codec, hdr.MsgType, payload)
+	return hdr, msg, err
+}
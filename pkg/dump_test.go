@@ -0,0 +1,48 @@
+package glink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDumpFrames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "frames.dump")
+	logger := loggo.GetLogger("default")
+	config := DefaultServerConfig()
+	config.DumpFrames = path
+	identity := newTestIdentity(t)
+	alice, err := NewServer(UserLightInfo{Uid: identity.Uid(), Name: "alice"}, identity, config, &logger)
+	require.Nil(t, err)
+	alice.Run(make(chan interface{}, 10))
+	bob, bobEvents := newTestServer(t, "bob")
+
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	sent := ChatMessage{Uid: "alice", Cid: "cid", Index: 1, Text: "hello"}
+	require.Nil(t, alice.SendTo(bob.own_info.Uid, sent))
+	require.IsType(t, PeerConnected{}, <-bobEvents)
+	require.IsType(t, NetEvent{}, <-bobEvents)
+	alice.Close()
+
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+
+	var msgs []any
+	err = ReadDump(file, func(rec DumpRecord) error {
+		_, msg, err := rec.Decode()
+		require.Nil(t, err)
+		require.WithinDuration(t, time.Now(), rec.Time, time.Minute)
+		msgs = append(msgs, msg)
+		return nil
+	})
+	require.Nil(t, err)
+	require.Len(t, msgs, 3)
+	require.IsType(t, ConnectInfo{}, msgs[0])
+	require.IsType(t, ConnectInfo{}, msgs[1])
+	require.Equal(t, sent, msgs[2])
+}
@@ -2,44 +2,122 @@ package glink
 
 import (
 	"encoding/binary"
-	"encoding/json"
+	"fmt"
+	"hash/crc32"
 )
 
+// MsgHeader precedes every frame on the wire. RequestId is not zero if the
+// sender waits for a reply, reply carries the same id and FlagResponse.
+// Checksum is CRC32 (IEEE) of the payload as it is sent, i.e. after
+// compression. Which fields are on the wire depends on protocol version of
+// the connection, see HeaderSize.
 type MsgHeader struct {
 	PayloadSize uint32
 	MsgType     uint16 // binary packet do not have PutUint8... wtf?
+	Flags       uint8
+	RequestId   uint32
+	Checksum    uint32
 }
 
+// MaxHeaderSize is the size of MsgHeader with all fields.
+const MaxHeaderSize = 15
+
+// HandshakeVersion is the frame layout of ConnectInfo and ConnectRefused.
+// It never changes, so that peer of any version can read the handshake and
+// learn why it is refused.
+const HandshakeVersion uint16 = 1
+
+// HeaderSize returns size of MsgHeader in given protocol version. Version 1
+// has only PayloadSize and MsgType, version 2 added Checksum, version 3 Flags
+// and version 4 RequestId.
+func HeaderSize(version uint16) int {
+	size := 6
+	if version >= 2 {
+		size += 4
+	}
+	if version >= 3 {
+		size += 1
+	}
+	if version >= 4 {
+		size += 4
+	}
+	return size
+}
+
+// MsgHeader flags
+const (
+	FlagCompressed uint8 = 1 << iota // payload is snappy encoded
+	FlagResponse                     // frame is a reply to RequestId
+)
+
+// MsgBytes is encoded message, Header is in the layout of Version.
 type MsgBytes struct {
+	Version uint16
 	Header  []byte
 	Payload []byte
 }
 
-func NewMsgBytes() *MsgBytes {
-	return &MsgBytes{Header: make([]byte, 6, 6)}
-}
-
-func EncodeHeader(hdr MsgHeader) ([]byte, error) {
-	header := make([]byte, 6)
+// EncodeHeader lays hdr out as protocol version expects. Fields the version
+// doesn't have must be zero.
+func EncodeHeader(hdr MsgHeader, version uint16) ([]byte, error) {
+	if hdr.Flags != 0 && version < 3 {
+		return nil, fmt.Errorf("Protocol version %d has no header flags", version)
+	}
+	if hdr.RequestId != 0 && version < 4 {
+		return nil, fmt.Errorf("Protocol version %d has no request id", version)
+	}
+	header := make([]byte, HeaderSize(version))
 	binary.LittleEndian.PutUint32(header, hdr.PayloadSize)
 	binary.LittleEndian.PutUint16(header[4:], hdr.MsgType)
+	pos := 6
+	if version >= 3 {
+		header[pos] = hdr.Flags
+		pos++
+	}
+	if version >= 4 {
+		binary.LittleEndian.PutUint32(header[pos:], hdr.RequestId)
+		pos += 4
+	}
+	if version >= 2 {
+		binary.LittleEndian.PutUint32(header[pos:], hdr.Checksum)
+	}
 	return header, nil
 }
 
-func DecodeHeader(bytes []byte) (MsgHeader, error) {
+func DecodeHeader(bytes []byte, version uint16) (MsgHeader, error) {
 	var res MsgHeader
+	if len(bytes) < HeaderSize(version) {
+		return res, fmt.Errorf("%w: header is %d bytes", ErrShortFrame, len(bytes))
+	}
 	res.PayloadSize = binary.LittleEndian.Uint32(bytes)
 	res.MsgType = binary.LittleEndian.Uint16(bytes[4:])
+	pos := 6
+	if version >= 3 {
+		res.Flags = bytes[pos]
+		pos++
+	}
+	if version >= 4 {
+		res.RequestId = binary.LittleEndian.Uint32(bytes[pos:])
+		pos += 4
+	}
+	if version >= 2 {
+		res.Checksum = binary.LittleEndian.Uint32(bytes[pos:])
+	}
 	return res, nil
 }
 
 func EncodeMsg(msg any) (MsgBytes, error) {
-	j, err := json.Marshal(msg)
+	return EncodeMsgWith(DefaultCodec, ProtocolVersion, msg)
+}
+
+func EncodeMsgWith(codec Codec, version uint16, msg any) (MsgBytes, error) {
+	j, err := codec.Marshal(msg)
 	if err != nil {
 		return MsgBytes{}, err
 	}
 
 	res := MsgBytes{
+		Version: version,
 		Payload: j,
 	}
 
@@ -51,16 +129,40 @@ func EncodeMsg(msg any) (MsgBytes, error) {
 	hdr := MsgHeader{
 		PayloadSize: uint32(len(j)),
 		MsgType:     msg_type,
+		Checksum:    crc32.ChecksumIEEE(j),
 	}
-	res.Header, err = EncodeHeader(hdr)
+	res.Header, err = EncodeHeader(hdr, version)
 
 	return res, err
 }
 
+// SetRequestId marks encoded message as a request (or a reply, if response is
+// set) with given id.
+func (m *MsgBytes) SetRequestId(id uint32, response bool) error {
+	hdr, err := DecodeHeader(m.Header, m.Version)
+	if err != nil {
+		return err
+	}
+	hdr.RequestId = id
+	if response {
+		hdr.Flags |= FlagResponse
+	}
+	header, err := EncodeHeader(hdr, m.Version)
+	if err != nil {
+		return err
+	}
+	m.Header = header
+	return nil
+}
+
 func DecodeMsg[T any](payload []byte) (T, error) {
+	return DecodeMsgWith[T](DefaultCodec, payload)
+}
+
+func DecodeMsgWith[T any](codec Codec, payload []byte) (T, error) {
 	var res T
 
-	err := json.Unmarshal(payload, &res)
+	err := codec.Unmarshal(payload, &res)
 	if err != nil {
 		return res, err
 	}
@@ -0,0 +1,129 @@
+package glink
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+const DefaultMaxFrameSize = 16 * 1024 * 1024
+
+var (
+	ErrShortFrame     = errors.New("Frame is truncated")
+	ErrFrameTooLarge  = errors.New("Frame is too large")
+	ErrBadChecksum    = errors.New("Frame checksum mismatch")
+	ErrBadCompression = errors.New("Cannot decompress frame")
+)
+
+// FrameReader reads MsgHeader + payload frames from a stream and returns
+// payload already decompressed. Errors wrap one of ErrShortFrame,
+// ErrFrameTooLarge, ErrBadChecksum or ErrBadCompression when the frame itself
+// is malformed, io.EOF means that peer closed the stream between frames.
+type FrameReader struct {
+	r       io.Reader
+	maxSize uint32
+	header  [MaxHeaderSize]byte
+	// Version is protocol version of the frame layout, ProtocolVersion by
+	// default. Server switches it after handshake.
+	Version uint16
+	// OnFrame, if set, gets every frame as it was read from the stream.
+	OnFrame func(frame []byte)
+}
+
+func NewFrameReader(r io.Reader, maxSize uint32) *FrameReader {
+	if maxSize == 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	return &FrameReader{r: r, maxSize: maxSize, Version: ProtocolVersion}
+}
+
+func (f *FrameReader) ReadFrame() (MsgHeader, []byte, error) {
+	header := f.header[:HeaderSize(f.Version)]
+	n, err := io.ReadFull(f.r, header)
+	if err == io.EOF {
+		return MsgHeader{}, nil, err
+	}
+	if err != nil {
+		return MsgHeader{}, nil, fmt.Errorf("%w: got %d of %d header bytes: %s", ErrShortFrame, n, len(header), err)
+	}
+	hdr, err := DecodeHeader(header, f.Version)
+	if err != nil {
+		return hdr, nil, err
+	}
+	if hdr.PayloadSize > f.maxSize {
+		return hdr, nil, fmt.Errorf("%w: %d bytes, limit is %d", ErrFrameTooLarge, hdr.PayloadSize, f.maxSize)
+	}
+
+	payload := make([]byte, hdr.PayloadSize)
+	n, err = io.ReadFull(f.r, payload)
+	if err != nil {
+		return hdr, nil, fmt.Errorf("%w: got %d of %d payload bytes: %s", ErrShortFrame, n, hdr.PayloadSize, err)
+	}
+	if f.OnFrame != nil {
+		f.OnFrame(EncodeFrame(MsgBytes{Header: header, Payload: payload}))
+	}
+	if f.Version >= 2 && crc32.ChecksumIEEE(payload) != hdr.Checksum {
+		return hdr, nil, fmt.Errorf("%w for message type %d", ErrBadChecksum, hdr.MsgType)
+	}
+	if hdr.Flags&FlagCompressed != 0 {
+		payload, err = f.decompress(payload)
+		if err != nil {
+			return hdr, nil, err
+		}
+	}
+	return hdr, payload, nil
+}
+
+func (f *FrameReader) decompress(payload []byte) ([]byte, error) {
+	size, err := snappy.DecodedLen(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadCompression, err)
+	}
+	if size > int(f.maxSize) {
+		return nil, fmt.Errorf("%w: %d bytes after decompression, limit is %d", ErrFrameTooLarge, size, f.maxSize)
+	}
+	res, err := snappy.Decode(nil, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadCompression, err)
+	}
+	return res, nil
+}
+
+// CompressMsg replaces payload with its snappy encoding, unless compression
+// doesn't make it smaller.
+func CompressMsg(msg MsgBytes) (MsgBytes, error) {
+	hdr, err := DecodeHeader(msg.Header, msg.Version)
+	if err != nil {
+		return msg, err
+	}
+	compressed := snappy.Encode(nil, msg.Payload)
+	if len(compressed) >= len(msg.Payload) {
+		return msg, nil
+	}
+
+	hdr.PayloadSize = uint32(len(compressed))
+	hdr.Flags |= FlagCompressed
+	hdr.Checksum = crc32.ChecksumIEEE(compressed)
+	header, err := EncodeHeader(hdr, msg.Version)
+	if err != nil {
+		return msg, err
+	}
+	return MsgBytes{Version: msg.Version, Header: header, Payload: compressed}, nil
+}
+
+// EncodeFrame puts header and payload into one buffer, so the frame goes to
+// the socket with a single write.
+func EncodeFrame(bytes MsgBytes) []byte {
+	frame := make([]byte, 0, len(bytes.Header)+len(bytes.Payload))
+	frame = append(frame, bytes.Header...)
+	return append(frame, bytes.Payload...)
+}
+
+// WriteFrame writes already encoded message to the stream.
+func WriteFrame(w io.Writer, bytes MsgBytes) error {
+	_, err := w.Write(EncodeFrame(bytes))
+	return err
+}
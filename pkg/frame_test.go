@@ -0,0 +1,113 @@
+package glink
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func encodeFrame(t *testing.T, msg any) []byte {
+	var buf bytes.Buffer
+	msgBytes, err := EncodeMsg(msg)
+	require.Nil(t, err)
+	require.Nil(t, WriteFrame(&buf, msgBytes))
+	return buf.Bytes()
+}
+
+func TestFrameReadPartialStream(t *testing.T) {
+	msg1 := ChatMessage{Uid: "uid", Cid: "cid", Index: 1, Text: "first"}
+	msg2 := ChatMessage{Uid: "uid", Cid: "cid", Index: 2, Text: "second"}
+	stream := append(encodeFrame(t, msg1), encodeFrame(t, msg2)...)
+
+	reader := NewFrameReader(iotest.OneByteReader(bytes.NewReader(stream)), 0)
+	for _, expected := range []ChatMessage{msg1, msg2} {
+		_, payload, err := reader.ReadFrame()
+		require.Nil(t, err)
+		msg, err := DecodeMsg[ChatMessage](payload)
+		require.Nil(t, err)
+		require.Equal(t, expected, msg)
+	}
+	_, _, err := reader.ReadFrame()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	frame := encodeFrame(t, ChatMessage{Text: "some long enough text"})
+	reader := NewFrameReader(bytes.NewReader(frame), 10)
+	_, _, err := reader.ReadFrame()
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+}
+
+func TestFrameBadChecksum(t *testing.T) {
+	frame := encodeFrame(t, ChatMessage{Text: "text"})
+	frame[len(frame)-2] ^= 0xff
+	reader := NewFrameReader(bytes.NewReader(frame), 0)
+	_, _, err := reader.ReadFrame()
+	require.True(t, errors.Is(err, ErrBadChecksum))
+}
+
+func TestFrameTruncated(t *testing.T) {
+	frame := encodeFrame(t, ChatMessage{Text: "text"})
+	reader := NewFrameReader(bytes.NewReader(frame[:len(frame)-1]), 0)
+	_, _, err := reader.ReadFrame()
+	require.True(t, errors.Is(err, ErrShortFrame))
+
+	reader = NewFrameReader(bytes.NewReader(frame[:3]), 0)
+	_, _, err = reader.ReadFrame()
+	require.True(t, errors.Is(err, ErrShortFrame))
+}
+
+func TestFrameLayoutPerVersion(t *testing.T) {
+	require.Equal(t, 6, HeaderSize(HandshakeVersion))
+	msg := ChatMessage{Uid: "uid", Cid: "cid", Index: 1, Text: "text"}
+	for version := HandshakeVersion; version <= ProtocolVersion; version++ {
+		msgBytes, err := EncodeMsgWith(DefaultCodec, version, msg)
+		require.Nil(t, err)
+		require.Len(t, msgBytes.Header, HeaderSize(version))
+		if version >= 4 {
+			require.Nil(t, msgBytes.SetRequestId(7, true))
+		} else {
+			require.NotNil(t, msgBytes.SetRequestId(7, true), version)
+		}
+
+		reader := NewFrameReader(iotest.OneByteReader(bytes.NewReader(EncodeFrame(msgBytes))), 0)
+		reader.Version = version
+		hdr, payload, err := reader.ReadFrame()
+		require.Nil(t, err, version)
+		require.Equal(t, uint32(len(payload)), hdr.PayloadSize)
+		decoded, err := DecodeMsg[ChatMessage](payload)
+		require.Nil(t, err)
+		require.Equal(t, msg, decoded)
+		if version >= 4 {
+			require.Equal(t, uint32(7), hdr.RequestId)
+		}
+	}
+}
+
+func TestFrameCompressed(t *testing.T) {
+	msg := ChatMessagePack{From: "uid1", To: "uid2"}
+	for i := 0; i < 100; i++ {
+		msg.Messages = append(msg.Messages, ChatMessage{Uid: "uid1", Cid: "cid", Index: uint32(i), Text: "same old text"})
+	}
+	plain, err := EncodeMsg(msg)
+	require.Nil(t, err)
+	compressed, err := CompressMsg(plain)
+	require.Nil(t, err)
+	require.Less(t, len(compressed.Payload), len(plain.Payload))
+
+	var buf bytes.Buffer
+	require.Nil(t, WriteFrame(&buf, compressed))
+	hdr, payload, err := NewFrameReader(&buf, 0).ReadFrame()
+	require.Nil(t, err)
+	require.Equal(t, FlagCompressed, hdr.Flags&FlagCompressed)
+	require.Equal(t, plain.Payload, payload)
+
+	buf.Reset()
+	require.Nil(t, WriteFrame(&buf, compressed))
+	_, _, err = NewFrameReader(&buf, uint32(len(plain.Payload)-1)).ReadFrame()
+	require.True(t, errors.Is(err, ErrFrameTooLarge))
+}
@@ -0,0 +1,175 @@
+package glink
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/mdns"
+	"github.com/juju/loggo"
+)
+
+const (
+	mdnsService = "_glink._tcp"
+	// mdnsBrowseInterval is the pause between queries for other nodes. It
+	// must be well below NodeTimeout, otherwise live nodes are reported lost.
+	mdnsBrowseInterval = time.Second
+	mdnsQueryTimeout   = time.Second
+)
+
+// MdnsDiscovery advertises and browses _glink._tcp DNS-SD service. It works
+// in networks that filter multicast announces of Discovery but allow mDNS.
+// Signed NodeAnnounce is kept in TXT records, see announceTxt.
+type MdnsDiscovery struct {
+	NewNodes chan interface{}
+	OwnInfo  NodeAnnounce
+	config   DiscoveryConfig
+	log      *loggo.Logger
+	server   *mdns.Server
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewMdnsDiscovery(own_info NodeAnnounce, config DiscoveryConfig, log *loggo.Logger) *MdnsDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MdnsDiscovery{OwnInfo: own_info, config: config, log: log, ctx: ctx, cancel: cancel}
+}
+
+func (d *MdnsDiscovery) Run(eventChan chan interface{}) error {
+	d.NewNodes = eventChan
+	iface, err := d.config.iface()
+	if err != nil {
+		return fmt.Errorf("Bad discovery config: %w", err)
+	}
+	host, port_str, err := net.SplitHostPort(d.OwnInfo.Endpoint)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(port_str)
+	if err != nil {
+		return err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+		ips = []net.IP{ip}
+	}
+	service, err := mdns.NewMDNSService(string(d.OwnInfo.Uid), mdnsService, "", "", port, ips, announceTxt(d.OwnInfo))
+	if err != nil {
+		return fmt.Errorf("Cannot create mDNS service: %w", err)
+	}
+	d.server, err = mdns.NewServer(&mdns.Config{Zone: service, Iface: iface})
+	if err != nil {
+		return fmt.Errorf("Cannot start mDNS server: %w", err)
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.browse(iface)
+	}()
+	return nil
+}
+
+// Close stops advertising and returns when browsing is done. Query in
+// progress is not interrupted, so it may take mdnsQueryTimeout.
+func (d *MdnsDiscovery) Close() {
+	d.cancel()
+	if d.server != nil {
+		d.server.Shutdown()
+	}
+	d.wg.Wait()
+}
+
+// emit passes event to the service unless discovery is closed.
+func (d *MdnsDiscovery) emit(ev interface{}) {
+	select {
+	case d.NewNodes <- ev:
+	case <-d.ctx.Done():
+	}
+}
+
+func (d *MdnsDiscovery) browse(iface *net.Interface) {
+	tracker := newNodeTracker(d.config.NodeTimeout)
+	for d.ctx.Err() == nil {
+		entries := make(chan *mdns.ServiceEntry, 16)
+		go func() {
+			params := mdns.DefaultParams(mdnsService)
+			params.Entries = entries
+			params.Interface = iface
+			params.Timeout = mdnsQueryTimeout
+			err := mdns.Query(params)
+			if err != nil {
+				d.log.Debugf("mDNS query failed: %s", err)
+			}
+			close(entries)
+		}()
+
+		for entry := range entries {
+			msg, err := announceFromTxt(entry.InfoFields)
+			if err == nil {
+				err = VerifyAnnounce(msg)
+			}
+			if err != nil {
+				d.log.Warningf("Drop mDNS announce %s: %s", entry.Name, err)
+				continue
+			}
+			info := discoveryInfo(msg)
+			info.Source = BackendMdns
+			if ev := tracker.seen(info, time.Now()); ev != nil {
+				d.emit(ev)
+			}
+		}
+		for _, lost := range tracker.expire(time.Now()) {
+			d.emit(lost)
+		}
+		select {
+		case <-time.After(mdnsBrowseInterval):
+		case <-d.ctx.Done():
+		}
+	}
+}
+
+// announceTxt packs signed announce into TXT records. Each record is limited
+// to 255 bytes, so node name must not be too long.
+func announceTxt(msg NodeAnnounce) []string {
+	return []string{
+		"uid=" + string(msg.Uid),
+		"name=" + msg.Name,
+		"ep=" + msg.Endpoint,
+		"key=" + base64.StdEncoding.EncodeToString(msg.PublicKey),
+		"sig=" + base64.StdEncoding.EncodeToString(msg.Signature),
+	}
+}
+
+func announceFromTxt(fields []string) (NodeAnnounce, error) {
+	var msg NodeAnnounce
+	var err error
+	for _, field := range fields {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "uid":
+			msg.Uid = Uid(value)
+		case "name":
+			msg.Name = value
+		case "ep":
+			msg.Endpoint = value
+		case "key":
+			msg.PublicKey, err = base64.StdEncoding.DecodeString(value)
+		case "sig":
+			msg.Signature, err = base64.StdEncoding.DecodeString(value)
+		}
+		if err != nil {
+			return msg, fmt.Errorf("Bad TXT record %s: %w", key, err)
+		}
+	}
+	if msg.Uid == "" || msg.Endpoint == "" {
+		return msg, errors.New("No uid or endpoint in TXT records")
+	}
+	return msg, nil
+}
@@ -0,0 +1,156 @@
+package glink
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// MultiDiscovery runs several backends at once and merges their events into
+// one stream. Node found by several backends is reported once, with Source
+// of the backend that found it first and Sources of all backends that see it.
+// NodeChanged is sent when the set of backends changes as well.
+type MultiDiscovery struct {
+	backends []IDiscovery
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+func NewMultiDiscovery(backends ...IDiscovery) *MultiDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MultiDiscovery{backends: backends, ctx: ctx, cancel: cancel}
+}
+
+func (d *MultiDiscovery) Run(eventChan chan interface{}) error {
+	events := make(chan interface{})
+	for i, backend := range d.backends {
+		err := backend.Run(events)
+		if err != nil {
+			for _, started := range d.backends[:i] {
+				started.Close()
+			}
+			return err
+		}
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		merger := newDiscoveryMerger()
+		for {
+			select {
+			case ev := <-events:
+				for _, out := range merger.merge(ev) {
+					select {
+					case eventChan <- out:
+					case <-d.ctx.Done():
+						return
+					}
+				}
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops merging first, so that backends blocked on sending events see
+// their own Close.
+func (d *MultiDiscovery) Close() {
+	d.cancel()
+	d.wg.Wait()
+	for _, backend := range d.backends {
+		backend.Close()
+	}
+}
+
+// discoveryMerger removes duplicate node events of different backends. It is
+// used only by the MultiDiscovery merge loop, so needs no locking.
+type discoveryMerger struct {
+	nodes map[Uid]*mergedNode
+}
+
+type mergedNode struct {
+	// current is the info that was reported last.
+	current DiscoveryInfo
+	// sources are infos of backends that see the node now.
+	sources map[string]DiscoveryInfo
+}
+
+func newDiscoveryMerger() *discoveryMerger {
+	return &discoveryMerger{nodes: make(map[Uid]*mergedNode)}
+}
+
+// merge returns events to pass on for the backend event.
+func (m *discoveryMerger) merge(ev interface{}) []interface{} {
+	switch ev := ev.(type) {
+	case DiscoveryInfo:
+		return m.seen(ev)
+
+	case NodeChanged:
+		return m.seen(ev.Info)
+
+	case NodeLost:
+		node, ok := m.nodes[ev.Uid]
+		if !ok {
+			return nil
+		}
+		if _, ok := node.sources[ev.Source]; !ok {
+			return nil
+		}
+		delete(node.sources, ev.Source)
+		if len(node.sources) == 0 {
+			delete(m.nodes, ev.Uid)
+			return []interface{}{ev}
+		}
+		if node.current.Source != ev.Source {
+			return m.update(node, node.current)
+		}
+		return m.update(node, node.sources[node.sourceNames()[0]])
+
+	default:
+		// Events without uid, like PeerAddress, can not be merged here. The
+		// service merges them after handshake, see GlinkService.addSource.
+		return []interface{}{ev}
+	}
+}
+
+func (m *discoveryMerger) seen(info DiscoveryInfo) []interface{} {
+	node, ok := m.nodes[info.ClientId]
+	if !ok {
+		info.Sources = []string{info.Source}
+		m.nodes[info.ClientId] = &mergedNode{
+			current: info,
+			sources: map[string]DiscoveryInfo{info.Source: info},
+		}
+		return []interface{}{info}
+	}
+	node.sources[info.Source] = info
+	if node.current.Source != info.Source {
+		return m.update(node, node.current)
+	}
+	return m.update(node, info)
+}
+
+// update makes info current and reports it if the node or the set of its
+// backends has changed.
+func (m *discoveryMerger) update(node *mergedNode, info DiscoveryInfo) []interface{} {
+	old := node.current
+	info.Sources = node.sourceNames()
+	node.current = info
+	if old.Endpoint == info.Endpoint && old.ClientName == info.ClientName && reflect.DeepEqual(old.Sources, info.Sources) {
+		return nil
+	}
+	return []interface{}{NodeChanged{Info: info, Old: old}}
+}
+
+func (n *mergedNode) sourceNames() []string {
+	names := make([]string, 0, len(n.sources))
+	for name := range n.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,191 @@
+package glink
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrSendQueueFull = errors.New("Send queue is full")
+
+const writeTimeout = 10 * time.Second
+
+// peerConn is an established connection with one peer. Frames are written by
+// the dedicated writeLoop goroutine, so concurrent senders never interleave on
+// the socket and slow peer doesn't block the caller.
+type peerConn struct {
+	conn              net.Conn
+	reader            *FrameReader
+	info              ConnectInfo
+	protocol          Protocol
+	outgoing          bool // dialed by us
+	compressThreshold uint32
+	queue             chan []byte
+	closing           chan struct{}
+	done              chan struct{} // closed when writeLoop returns
+	dumper            *FrameDumper
+	limiter           *peerLimiter
+
+	mu            sync.Mutex
+	closed        bool
+	closeReason   error
+	nextRequestId uint32
+	pending       map[uint32]chan any
+}
+
+func newPeerConn(conn net.Conn, reader *FrameReader, info ConnectInfo, protocol Protocol, config ServerConfig, dumper *FrameDumper) *peerConn {
+	p := &peerConn{
+		conn:              conn,
+		reader:            reader,
+		info:              info,
+		protocol:          protocol,
+		compressThreshold: config.CompressThreshold,
+		queue:             make(chan []byte, config.SendQueueSize),
+		closing:           make(chan struct{}),
+		done:              make(chan struct{}),
+		pending:           make(map[uint32]chan any),
+		dumper:            dumper,
+		limiter:           newPeerLimiter(config.RateLimit, time.Now()),
+	}
+	reader.Version = protocol.Version
+	if dumper != nil {
+		reader.OnFrame = func(frame []byte) {
+			dumper.Dump(DumpIn, info.MyUid, conn.RemoteAddr().String(), protocol.Codec, protocol.Version, frame)
+		}
+	}
+	return p
+}
+
+// send encodes msg with the codec negotiated for this connection and puts it
+// into the write queue. Write errors that happen later close the connection.
+func (p *peerConn) send(msg any, requestId uint32, response bool) error {
+	bytes, err := EncodeMsgWith(p.protocol.Codec, p.protocol.Version, msg)
+	if err != nil {
+		return err
+	}
+	if requestId != 0 {
+		err = bytes.SetRequestId(requestId, response)
+		if err != nil {
+			return err
+		}
+	}
+	if p.compressThreshold != 0 && len(bytes.Payload) > int(p.compressThreshold) && p.protocol.Has(FeatureSnappy) {
+		bytes, err = CompressMsg(bytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return ErrConnectionClosed
+	}
+	select {
+	case p.queue <- EncodeFrame(bytes):
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// writeLoop writes queued frames until the connection is closed or drained.
+func (p *peerConn) writeLoop() {
+	defer close(p.done)
+	defer p.conn.Close()
+	for {
+		select {
+		case frame, ok := <-p.queue:
+			if !ok {
+				// Drained, see drain.
+				return
+			}
+			p.dumper.Dump(DumpOut, p.info.MyUid, p.conn.RemoteAddr().String(), p.protocol.Codec, p.protocol.Version, frame)
+			p.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			_, err := p.conn.Write(frame)
+			if err != nil {
+				p.close(err)
+				return
+			}
+		case <-p.closing:
+			return
+		}
+	}
+}
+
+func (p *peerConn) addPending() (uint32, chan any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, nil, ErrConnectionClosed
+	}
+	p.nextRequestId++
+	if p.nextRequestId == 0 {
+		p.nextRequestId++
+	}
+	ch := make(chan any, 1)
+	p.pending[p.nextRequestId] = ch
+	return p.nextRequestId, ch, nil
+}
+
+func (p *peerConn) removePending(id uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.pending, id)
+}
+
+// resolvePending passes reply to the waiting Request. Returns false if
+// nobody waits for it anymore.
+func (p *peerConn) resolvePending(id uint32, reply any) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ch, ok := p.pending[id]
+	if !ok {
+		return false
+	}
+	delete(p.pending, id)
+	ch <- reply
+	return true
+}
+
+// close stops the writer and fails all pending requests. Only the first
+// reason is kept.
+func (p *peerConn) close(reason error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.closeReason = reason
+	close(p.closing)
+	p.conn.Close()
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+// drain is graceful close: new frames are refused, writeLoop writes already
+// queued ones and closes the connection.
+func (p *peerConn) drain(reason error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.closeReason = reason
+	close(p.queue)
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+}
+
+func (p *peerConn) reason() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closeReason
+}
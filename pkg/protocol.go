@@ -0,0 +1,96 @@
+package glink
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProtocolVersion is the newest wire protocol this build speaks,
+// MinProtocolVersion is the oldest one it still accepts.
+//
+// Version 2: MsgHeader carries payload checksum.
+// Version 3: MsgHeader carries flags.
+// Version 4: MsgHeader carries request id.
+// Version 5: chat messages carry only ciphertext, chat keys travel in invites.
+// Version 6: connections run over TLS with identity certificates.
+// Version 7: chat messages are signed by their authors.
+//
+// Header changes apply only after handshake, ConnectInfo and ConnectRefused
+// always keep the version 1 layout, see HandshakeVersion. Versions before 6
+// are refused, since they can't prove their Uid. Version 6 peers connect,
+// but chat messages they author are unsigned and rejected, see VerifyMessage.
+const (
+	ProtocolVersion    uint16 = 7
+	MinProtocolVersion uint16 = tlsProtocolVersion
+)
+
+// Optional capabilities announced in ConnectInfo. A feature may be used on a
+// connection only if both sides announced it.
+const (
+	FeatureSync   = "sync"   // WatchedCids -> HaveCidInfo -> MessagesRequest -> ChatMessagePack
+	FeatureSnappy = "snappy" // frames with FlagCompressed
+)
+
+var supportedFeatures = []string{FeatureSync, FeatureSnappy}
+
+// featureVersions are the lowest protocol versions whose frames can carry a
+// feature. Features are dropped from connections with older version.
+var featureVersions = map[string]uint16{
+	FeatureSnappy: 3, // MsgHeader.Flags
+	FeatureSync:   4, // MsgHeader.RequestId, see Server.Request
+}
+
+// tlsProtocolVersion is the first version that runs over TLS. Older peers
+// can not prove their Uid and are refused, see Server.refusePlain.
+const tlsProtocolVersion uint16 = 6
+
+const handshakeTimeout = 5 * time.Second
+
+// Protocol is the result of ConnectInfo negotiation for one connection.
+type Protocol struct {
+	Version  uint16
+	Features []string
+	Codec    Codec
+}
+
+func (p Protocol) Has(feature string) bool {
+	return contains(p.Features, feature)
+}
+
+func newConnectInfo(own_info UserLightInfo, identity *Identity) ConnectInfo {
+	return ConnectInfo{
+		MyUid:       own_info.Uid,
+		MyName:      own_info.Name,
+		BoxKey:      identity.Box.Public[:],
+		IdentityKey: identity.SignKey(),
+		MinVersion:  MinProtocolVersion,
+		MaxVersion:  ProtocolVersion,
+		Features:    supportedFeatures,
+		Codecs:      codecNames(knownCodecs),
+	}
+}
+
+// negotiateProtocol picks the highest protocol version supported by both
+// sides. Both ends run it on the same pair of ConnectInfo, so they agree on
+// the result without an extra round trip.
+func negotiateProtocol(own, peer ConnectInfo) (Protocol, error) {
+	if peer.MaxVersion == 0 {
+		return Protocol{}, fmt.Errorf("Peer %s does not announce protocol version, probably too old build", peer.MyName)
+	}
+	version := own.MaxVersion
+	if peer.MaxVersion < version {
+		version = peer.MaxVersion
+	}
+	if version < own.MinVersion || version < peer.MinVersion {
+		return Protocol{}, fmt.Errorf("No common protocol version with %s: ours is %d-%d, peer's is %d-%d",
+			peer.MyName, own.MinVersion, own.MaxVersion, peer.MinVersion, peer.MaxVersion)
+	}
+
+	res := Protocol{Version: version, Codec: negotiateCodec(own.Codecs, peer.Codecs)}
+	for _, f := range peer.Features {
+		if contains(own.Features, f) && version >= featureVersions[f] {
+			res.Features = append(res.Features, f)
+		}
+	}
+	return res, nil
+}
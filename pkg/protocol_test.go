@@ -0,0 +1,65 @@
+package glink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateProtocolPicksCommonVersion(t *testing.T) {
+	own := ConnectInfo{MyName: "own", MinVersion: 1, MaxVersion: 3, Features: []string{"a", "b"}}
+	peer := ConnectInfo{MyName: "peer", MinVersion: 2, MaxVersion: 5, Features: []string{"b", "c"}}
+
+	p, err := negotiateProtocol(own, peer)
+	require.Nil(t, err)
+	require.Equal(t, uint16(3), p.Version)
+	require.Equal(t, []string{"b"}, p.Features)
+
+	p2, err := negotiateProtocol(peer, own)
+	require.Nil(t, err)
+	require.Equal(t, p.Version, p2.Version)
+}
+
+func TestNegotiateProtocolDropsFeaturesOfNewerVersion(t *testing.T) {
+	own := ConnectInfo{MyName: "own", MinVersion: 1, MaxVersion: ProtocolVersion, Features: supportedFeatures}
+	peer := ConnectInfo{MyName: "peer", MinVersion: 1, MaxVersion: 2, Features: supportedFeatures}
+
+	p, err := negotiateProtocol(own, peer)
+	require.Nil(t, err)
+	require.False(t, p.Has(FeatureSnappy))
+
+	peer.MaxVersion = 3
+	p, err = negotiateProtocol(own, peer)
+	require.Nil(t, err)
+	require.True(t, p.Has(FeatureSnappy))
+	require.False(t, p.Has(FeatureSync))
+
+	peer.MaxVersion = 4
+	p, err = negotiateProtocol(own, peer)
+	require.Nil(t, err)
+	require.True(t, p.Has(FeatureSync))
+}
+
+func TestNegotiateProtocolAcceptsOldestSupported(t *testing.T) {
+	own := ConnectInfo{MyName: "own", MinVersion: MinProtocolVersion, MaxVersion: ProtocolVersion, Features: supportedFeatures}
+	peer := ConnectInfo{MyName: "peer", MinVersion: tlsProtocolVersion, MaxVersion: tlsProtocolVersion, Features: supportedFeatures}
+
+	p, err := negotiateProtocol(own, peer)
+	require.Nil(t, err)
+	require.Equal(t, tlsProtocolVersion, p.Version)
+	require.True(t, p.Has(FeatureSync))
+
+	peer.MinVersion, peer.MaxVersion = 5, 5
+	_, err = negotiateProtocol(own, peer)
+	require.NotNil(t, err)
+}
+
+func TestNegotiateProtocolRefuse(t *testing.T) {
+	own := ConnectInfo{MyName: "own", MinVersion: 3, MaxVersion: 4}
+
+	_, err := negotiateProtocol(own, ConnectInfo{MyName: "old", MinVersion: 1, MaxVersion: 2})
+	require.NotNil(t, err)
+
+	_, err = negotiateProtocol(own, ConnectInfo{MyName: "legacy"})
+	require.NotNil(t, err)
+}
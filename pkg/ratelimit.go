@@ -0,0 +1,124 @@
+package glink
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrBanned = errors.New("Temporarily banned")
+
+type RateLimitConfig struct {
+	// MsgRate is the number of messages of each type allowed per second,
+	// MsgBurst is how many of them may come at once. Zero rate disables
+	// the limit. Replies to our requests are not limited.
+	MsgRate  float64
+	MsgBurst float64
+	// ByteRate and ByteBurst limit payload bytes per connection in the same
+	// way. NewServer raises ByteBurst to MaxFrameSize, otherwise big frames
+	// would never pass.
+	ByteRate  float64
+	ByteBurst float64
+	// Peer that exceeds limits BanViolations times within BanWindow is
+	// disconnected and refused for BanDuration. Zero BanViolations disables
+	// bans, zero BanWindow counts violations for the whole connection.
+	BanViolations int
+	BanWindow     time.Duration
+	BanDuration   time.Duration
+}
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		MsgRate:       50,
+		MsgBurst:      200,
+		ByteRate:      4 << 20,
+		ByteBurst:     2 * DefaultMaxFrameSize,
+		BanViolations: 20,
+		BanWindow:     time.Minute,
+		BanDuration:   5 * time.Minute,
+	}
+}
+
+// tokenBucket allows burst events at once and rate events per second on
+// average.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64, now time.Time) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// peerLimiter keeps buckets of one connection. It is used only by the
+// connection read loop, so needs no locking.
+type peerLimiter struct {
+	config RateLimitConfig
+	bytes  *tokenBucket
+	msgs   map[uint16]*tokenBucket
+	// violations are times of the last BanViolations violations.
+	violations []time.Time
+}
+
+func newPeerLimiter(config RateLimitConfig, now time.Time) *peerLimiter {
+	l := &peerLimiter{config: config, msgs: make(map[uint16]*tokenBucket)}
+	if config.ByteRate != 0 {
+		l.bytes = newTokenBucket(config.ByteRate, config.ByteBurst, now)
+	}
+	return l
+}
+
+// allow returns error if the frame exceeds limits and must be dropped.
+func (l *peerLimiter) allow(msgType uint16, response bool, size int, now time.Time) error {
+	if l.bytes != nil && !l.bytes.take(float64(size), now) {
+		return l.violation(fmt.Errorf("more than %.0f bytes per second", l.config.ByteRate), now)
+	}
+	if response || l.config.MsgRate == 0 {
+		return nil
+	}
+	bucket, ok := l.msgs[msgType]
+	if !ok {
+		bucket = newTokenBucket(l.config.MsgRate, l.config.MsgBurst, now)
+		l.msgs[msgType] = bucket
+	}
+	if !bucket.take(1, now) {
+		return l.violation(fmt.Errorf("more than %.0f %s per second", l.config.MsgRate, GetTypeName(msgType)), now)
+	}
+	return nil
+}
+
+func (l *peerLimiter) violation(err error, now time.Time) error {
+	if l.config.BanViolations == 0 {
+		return err
+	}
+	l.violations = append(l.violations, now)
+	if len(l.violations) > l.config.BanViolations {
+		l.violations = l.violations[1:]
+	}
+	return err
+}
+
+// shouldBan is true when the peer exceeded limits too many times recently.
+// Long lived connection that bursts now and then is never banned.
+func (l *peerLimiter) shouldBan() bool {
+	if l.config.BanViolations == 0 || len(l.violations) < l.config.BanViolations {
+		return false
+	}
+	window := l.violations[len(l.violations)-1].Sub(l.violations[0])
+	return l.config.BanWindow == 0 || window <= l.config.BanWindow
+}
@@ -0,0 +1,96 @@
+package glink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+	require.True(t, b.take(3, now))
+	require.False(t, b.take(1, now))
+	require.True(t, b.take(1, now.Add(500*time.Millisecond)))
+	require.False(t, b.take(1, now.Add(500*time.Millisecond)))
+	// Tokens never exceed burst.
+	require.True(t, b.take(3, now.Add(time.Hour)))
+	require.False(t, b.take(1, now.Add(time.Hour)))
+}
+
+func TestPeerLimiter(t *testing.T) {
+	now := time.Now()
+	l := newPeerLimiter(RateLimitConfig{MsgRate: 1, MsgBurst: 2, ByteRate: 100, ByteBurst: 100, BanViolations: 2}, now)
+	require.Nil(t, l.allow(1, false, 10, now))
+	require.Nil(t, l.allow(1, false, 10, now))
+	// Other message types have own buckets, replies are not limited.
+	require.Nil(t, l.allow(2, false, 10, now))
+	require.Nil(t, l.allow(1, true, 10, now))
+	require.NotNil(t, l.allow(1, false, 10, now))
+	require.False(t, l.shouldBan())
+	require.NotNil(t, l.allow(3, false, 1000, now))
+	require.True(t, l.shouldBan())
+}
+
+func TestPeerLimiterViolationsExpire(t *testing.T) {
+	now := time.Now()
+	l := newPeerLimiter(RateLimitConfig{MsgRate: 1, MsgBurst: 1, BanViolations: 3, BanWindow: time.Minute}, now)
+	for i := 0; i < 10; i++ {
+		now = now.Add(40 * time.Second)
+		require.Nil(t, l.allow(1, false, 10, now))
+		require.NotNil(t, l.allow(1, false, 10, now))
+		require.False(t, l.shouldBan())
+	}
+	require.NotNil(t, l.allow(1, false, 10, now))
+	require.True(t, l.shouldBan())
+}
+
+func TestServerByteBurstFitsMaxFrame(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	identity := newTestIdentity(t)
+	config := DefaultServerConfig()
+	config.MaxFrameSize = 16 * DefaultMaxFrameSize
+	s, err := NewServer(UserLightInfo{Uid: identity.Uid(), Name: "bob"}, identity, config, &logger)
+	require.Nil(t, err)
+	t.Cleanup(s.Close)
+	require.Equal(t, float64(config.MaxFrameSize), s.config.RateLimit.ByteBurst)
+	l := newPeerLimiter(s.config.RateLimit, time.Now())
+	require.Nil(t, l.allow(1, false, int(config.MaxFrameSize), time.Now()))
+}
+
+func TestServerBansFlooder(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	config := DefaultServerConfig()
+	config.RateLimit = RateLimitConfig{MsgRate: 1, MsgBurst: 5, BanViolations: 3, BanDuration: time.Minute}
+	identity := newTestIdentity(t)
+	bob, err := NewServer(UserLightInfo{Uid: identity.Uid(), Name: "bob"}, identity, config, &logger)
+	require.Nil(t, err)
+	bobEvents := make(chan interface{}, 100)
+	bob.Run(bobEvents)
+	t.Cleanup(bob.Close)
+	alice, aliceEvents := newTestServer(t, "alice")
+
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	require.IsType(t, PeerConnected{}, <-aliceEvents)
+	require.IsType(t, PeerConnected{}, <-bobEvents)
+	for i := 0; i < 20; i++ {
+		alice.SendTo(bob.own_info.Uid, ChatMessage{Index: uint32(i)})
+	}
+	received := 0
+	for disconnected := false; !disconnected; {
+		select {
+		case ev := <-bobEvents:
+			_, disconnected = ev.(PeerDisconnected)
+			if !disconnected {
+				received++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Flooder is not disconnected")
+		}
+	}
+	require.Equal(t, 5, received)
+	<-aliceEvents
+	require.ErrorIs(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()), ErrConnectionRefused)
+}
@@ -0,0 +1,111 @@
+package glink
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+var ErrUnknownMsgType = errors.New("Unknown message type")
+
+// msgType describes one message struct that can travel over the wire.
+type msgType struct {
+	id      uint16
+	name    string
+	decode  func(codec Codec, payload []byte) (any, error)
+	handler func(g *GlinkService, ev NetEvent)
+}
+
+type msgRegistry struct {
+	byId   map[uint16]*msgType
+	byType map[reflect.Type]*msgType
+}
+
+var registry = msgRegistry{
+	byId:   make(map[uint16]*msgType),
+	byType: make(map[reflect.Type]*msgType),
+}
+
+// registerMsg binds message struct T to its wire id. If handler is not nil,
+// GlinkService calls it for every T received from network. Ids must never be
+// reused, since they are part of the protocol.
+func registerMsg[T any](id uint16, handler func(*GlinkService, T)) {
+	info := addMsgType[T](id)
+	if handler != nil {
+		info.handler = func(g *GlinkService, ev NetEvent) {
+			handler(g, ev.Msg.(T))
+		}
+	}
+}
+
+// registerRequestMsg is like registerMsg, but handler result is sent back to
+// the peer: as a reply if the peer waits for it, as a plain message otherwise.
+func registerRequestMsg[T any, R any](id uint16, handler func(*GlinkService, T) (R, error)) {
+	info := addMsgType[T](id)
+	info.handler = func(g *GlinkService, ev NetEvent) {
+		reply, err := handler(g, ev.Msg.(T))
+		if err != nil {
+			g.log.Errorf("Cannot handle %s from %s: %s", info.name, ev.From, err)
+			return
+		}
+		if ev.RequestId != 0 {
+			err = g.server.Reply(ev.From, ev.RequestId, reply)
+		} else {
+			err = g.server.SendTo(ev.From, reply)
+		}
+		if err != nil {
+			g.log.Errorf("Cannot answer %s to %s: %s", info.name, ev.From, err)
+		}
+	}
+}
+
+func addMsgType[T any](id uint16) *msgType {
+	var zero T
+	t := reflect.TypeOf(zero)
+	if prev, ok := registry.byId[id]; ok {
+		panic(fmt.Sprintf("Message id %d is already used by %s", id, prev.name))
+	}
+	if _, ok := registry.byType[t]; ok {
+		panic(fmt.Sprintf("Message %s is already registered", t.Name()))
+	}
+
+	info := &msgType{
+		id:   id,
+		name: t.Name(),
+		decode: func(codec Codec, payload []byte) (any, error) {
+			return DecodeMsgWith[T](codec, payload)
+		},
+	}
+	registry.byId[id] = info
+	registry.byType[t] = info
+	return info
+}
+
+func (r *msgRegistry) lookup(msg any) (*msgType, bool) {
+	info, ok := r.byType[reflect.TypeOf(msg)]
+	return info, ok
+}
+
+func (r *msgRegistry) decode(codec Codec, id uint16, payload []byte) (any, error) {
+	info, ok := r.byId[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", ErrUnknownMsgType, id)
+	}
+	return info.decode(codec, payload)
+}
+
+func GetTypeId(msg any) (uint16, error) {
+	info, ok := registry.lookup(msg)
+	if !ok {
+		return 0, fmt.Errorf("%w %s", ErrUnknownMsgType, reflect.TypeOf(msg).Name())
+	}
+	return info.id, nil
+}
+
+func GetTypeName(id uint16) string {
+	info, ok := registry.byId[id]
+	if !ok {
+		return fmt.Sprintf("unknown(%d)", id)
+	}
+	return info.name
+}
@@ -0,0 +1,30 @@
+package glink
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryEncodeDecode(t *testing.T) {
+	msg := JoinChat{From: "uid1", To: "uid2", Cid: "cid"}
+	bytes, err := EncodeMsg(msg)
+	require.Nil(t, err)
+
+	hdr, err := DecodeHeader(bytes.Header, bytes.Version)
+	require.Nil(t, err)
+	require.Equal(t, uint16(3), hdr.MsgType)
+
+	ev, err := registry.decode(DefaultCodec, hdr.MsgType, bytes.Payload)
+	require.Nil(t, err)
+	require.Equal(t, msg, ev)
+}
+
+func TestRegistryUnknownType(t *testing.T) {
+	_, err := registry.decode(DefaultCodec, 65535, []byte("{}"))
+	require.True(t, errors.Is(err, ErrUnknownMsgType))
+
+	_, err = GetTypeId(ChatUpdate{})
+	require.True(t, errors.Is(err, ErrUnknownMsgType))
+}
@@ -1,56 +1,175 @@
 package glink
 
 import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"reflect"
+	"sync"
+	"time"
 
 	"github.com/juju/loggo"
 )
 
-func SendToAll[T any](s IServer, msg T) error {
-	bytes, err := EncodeMsg(msg)
-	if err != nil {
-		return err
-	}
-	return s.SendToAll(bytes)
-}
+var (
+	ErrConnectionClosed    = errors.New("Connection closed")
+	ErrConnectionRefused   = errors.New("Connection refused")
+	ErrServerClosed        = errors.New("Server is closed")
+	ErrNoRequestId         = errors.New("Protocol version has no request id")
+	ErrDuplicateConnection = errors.New("Duplicate connection")
+)
 
-func SendTo[T any](s IServer, uid Uid, msg T) error {
-	bytes, err := EncodeMsg(msg)
+// Request sends msg to uid and waits for the reply of type R.
+func Request[R any](ctx context.Context, s IServer, uid Uid, msg any) (R, error) {
+	var res R
+	reply, err := s.Request(ctx, uid, msg)
 	if err != nil {
-		return err
+		return res, err
 	}
-	return s.SendTo(uid, bytes)
+	res, ok := reply.(R)
+	if !ok {
+		return res, fmt.Errorf("Unexpected reply of type %s on %s", reflect.TypeOf(reply).Name(), reflect.TypeOf(msg).Name())
+	}
+	return res, nil
 }
 
 type IServer interface {
 	Run(chan interface{})
 	ListenerAddress() string
-	SendTo(Uid, MsgBytes) error
-	SendToAll(MsgBytes) error
+	SendTo(uid Uid, msg any) error
+	// SendToAll sends msg to every peer skip returns false for.
+	SendToAll(msg any, skip func(uid Uid) bool) error
+	// Request sends msg and blocks until the peer replies or ctx is done.
+	Request(ctx context.Context, uid Uid, msg any) (any, error)
+	// Reply answers to NetEvent with not zero RequestId.
+	Reply(uid Uid, requestId uint32, msg any) error
 	MakeNewConnectionTo(uid Uid, endpoint string) error
+	// ConnectTo connects to whoever listens on endpoint.
+	ConnectTo(endpoint string) (ConnectInfo, error)
+	SupportsFeature(uid Uid, feature string) bool
+	// PeerInfo returns ConnectInfo the connected peer sent in handshake.
+	PeerInfo(uid Uid) (ConnectInfo, bool)
+	// SetAdmission installs check that runs for every peer after its identity
+	// is proven. Peers it returns error for are refused. Call before Run.
+	SetAdmission(admit func(info ConnectInfo) error)
+	// Disconnect closes connection with the peer, if there is one.
+	Disconnect(uid Uid, reason error)
+	// Close stops the server and returns when all its goroutines are done.
+	Close()
+}
+
+// NetEvent is a message received from the peer From. If RequestId is not
+// zero, peer waits for an answer sent with IServer.Reply.
+type NetEvent struct {
+	From      Uid
+	RequestId uint32
+	Msg       any
+}
+
+// PeerConnected is sent to the event channel when handshake with the peer is
+// done, before any NetEvent from it.
+type PeerConnected struct {
+	Uid  Uid
+	Name string
+}
+
+// PeerDisconnected is sent to the event channel when connection with the peer
+// is closed by any side or because of an error.
+type PeerDisconnected struct {
+	Uid    Uid
+	Name   string
+	Reason error
+}
+
+type ServerConfig struct {
+	// ListenAddress is host:port peers connect to. Static peers on other
+	// hosts need an address reachable from there.
+	ListenAddress string
+	// MaxFrameSize limits payload size of incoming frames.
+	MaxFrameSize uint32
+	// Payloads bigger than CompressThreshold are compressed if peer supports it.
+	// Zero disables compression.
+	CompressThreshold uint32
+	// SendQueueSize is the number of outgoing frames buffered per connection.
+	SendQueueSize int
+	// DumpFrames is a path to file where all frames are recorded. Empty
+	// string disables dump. See cmd/glink-dump for reading it.
+	DumpFrames string
+	RateLimit  RateLimitConfig
+}
+
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ListenAddress:     "localhost:0",
+		MaxFrameSize:      DefaultMaxFrameSize,
+		CompressThreshold: 1024,
+		SendQueueSize:     64,
+		RateLimit:         DefaultRateLimitConfig(),
+	}
 }
 
-// TODO: mutex
 type Server struct {
 	listener    net.Listener
-	connections map[Uid]net.Conn
+	mu          sync.Mutex
+	connections map[Uid]*peerConn
+	bans        map[Uid]time.Time
 	NewEvent    chan interface{}
 	log         *loggo.Logger
 	own_info    UserLightInfo
+	identity    *Identity
+	tlsConfig   *tls.Config
+	admit       func(info ConnectInfo) error
+	config      ServerConfig
+	dumper      *FrameDumper
+	// handshakes are accepted connections that are not peers yet, Close
+	// aborts them.
+	handshakes map[net.Conn]struct{}
+	// closed is set by Close, no connections are added after it.
+	closed    bool
+	ctx       context.Context
+	cancel    context.CancelFunc
+	wg        sync.WaitGroup
+	closeOnce sync.Once
 }
 
-func NewServer(own_info UserLightInfo, log *loggo.Logger) (*Server, error) {
-	listener, err := net.Listen("tcp", "localhost:0000")
+func NewServer(own_info UserLightInfo, identity *Identity, config ServerConfig, log *loggo.Logger) (*Server, error) {
+	tlsConfig, err := newTlsConfig(own_info, identity)
+	if err != nil {
+		return nil, err
+	}
+	if config.RateLimit.ByteBurst < float64(config.MaxFrameSize) {
+		config.RateLimit.ByteBurst = float64(config.MaxFrameSize)
+	}
+	listener, err := net.Listen("tcp", config.ListenAddress)
 	if err != nil {
 		return nil, fmt.Errorf("Cannot bind: %w", err)
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	server := Server{
 		listener:    listener,
-		connections: make(map[Uid]net.Conn),
+		handshakes:  make(map[net.Conn]struct{}),
+		ctx:         ctx,
+		cancel:      cancel,
+		tlsConfig:   tlsConfig,
+		connections: make(map[Uid]*peerConn),
+		bans:        make(map[Uid]time.Time),
 		log:         log,
 		own_info:    own_info,
+		identity:    identity,
+		config:      config,
+	}
+	if config.DumpFrames != "" {
+		server.dumper, err = NewFrameDumper(config.DumpFrames)
+		if err != nil {
+			cancel()
+			listener.Close()
+			return nil, err
+		}
 	}
 
 	return &server, nil
@@ -62,146 +181,563 @@ func (s *Server) ListenerAddress() string {
 
 func (s *Server) Run(eventChan chan interface{}) {
 	s.NewEvent = eventChan
-	go s.acceptLoop()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.acceptLoop()
+	}()
+}
+
+// emit passes event to the service unless the server is closed.
+func (s *Server) emit(ev interface{}) bool {
+	select {
+	case s.NewEvent <- ev:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
 }
 
-func (s *Server) SendTo(uid Uid, bytes MsgBytes) error {
-	conn, ok := s.connections[uid]
+func (s *Server) getPeer(uid Uid) (*peerConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.connections[uid]
 	if !ok {
-		return errors.New("Cannot get connection to " + string(uid))
+		return nil, errors.New("Cannot get connection to " + string(uid))
+	}
+	return peer, nil
+}
+
+func (s *Server) SendTo(uid Uid, msg any) error {
+	peer, err := s.getPeer(uid)
+	if err != nil {
+		return err
+	}
+	return peer.send(msg, 0, false)
+}
+
+// SendToAll tries every connection, except the ones skip returns true for,
+// and returns the first error, if any.
+func (s *Server) SendToAll(msg any, skip func(uid Uid) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res error
+	for uid, peer := range s.connections {
+		if skip(uid) {
+			continue
+		}
+		err := peer.send(msg, 0, false)
+		if err != nil && res == nil {
+			res = fmt.Errorf("Cannot send to %s: %w", uid, err)
+		}
 	}
-	conn.Write(bytes.Header)
-	conn.Write(bytes.Payload)
-	return nil
+	return res
 }
 
-func (s *Server) SendToAll(bytes MsgBytes) error {
-	for _, conn := range s.connections {
-		conn.Write(bytes.Header)
-		conn.Write(bytes.Payload)
+func (s *Server) Request(ctx context.Context, uid Uid, msg any) (any, error) {
+	peer, err := s.getPeer(uid)
+	if err != nil {
+		return nil, err
+	}
+	if peer.protocol.Version < 4 {
+		return nil, fmt.Errorf("%w: %s speaks version %d", ErrNoRequestId, peer.info.MyName, peer.protocol.Version)
+	}
+	id, replyChan, err := peer.addPending()
+	if err != nil {
+		return nil, err
+	}
+	defer peer.removePending(id)
+
+	err = peer.send(msg, id, false)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply, ok := <-replyChan:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
-	return nil
 }
 
+func (s *Server) Reply(uid Uid, requestId uint32, msg any) error {
+	peer, err := s.getPeer(uid)
+	if err != nil {
+		return err
+	}
+	return peer.send(msg, requestId, true)
+}
+
+func (s *Server) SupportsFeature(uid Uid, feature string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.connections[uid]
+	return ok && peer.protocol.Has(feature)
+}
+
+func (s *Server) SetAdmission(admit func(info ConnectInfo) error) {
+	s.admit = admit
+}
+
+func (s *Server) admitPeer(info ConnectInfo) error {
+	s.mu.Lock()
+	until, banned := s.bans[info.MyUid]
+	if banned && time.Now().After(until) {
+		delete(s.bans, info.MyUid)
+		banned = false
+	}
+	s.mu.Unlock()
+	if banned {
+		return fmt.Errorf("%w until %s", ErrBanned, until.Format("15:04:05"))
+	}
+	if s.admit == nil {
+		return nil
+	}
+	return s.admit(info)
+}
+
+func (s *Server) ban(peer *peerConn) {
+	duration := s.config.RateLimit.BanDuration
+	s.log.Warningf("Ban %s(%s) for %s: too many rate limit violations", peer.info.MyName, peer.info.MyUid, duration)
+	s.mu.Lock()
+	s.bans[peer.info.MyUid] = time.Now().Add(duration)
+	s.mu.Unlock()
+}
+
+func (s *Server) PeerInfo(uid Uid) (ConnectInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.connections[uid]
+	if !ok {
+		return ConnectInfo{}, false
+	}
+	return peer.info, true
+}
+
+// Disconnect closes connection with the peer without waiting for its queued
+// frames. PeerDisconnected is sent as usual.
+func (s *Server) Disconnect(uid Uid, reason error) {
+	s.mu.Lock()
+	peer, ok := s.connections[uid]
+	s.mu.Unlock()
+	if ok {
+		s.log.Infof("Disconnect %s(%s): %s", peer.info.MyName, uid, reason)
+		peer.close(reason)
+	}
+}
+
+// Close stops accepting connections and aborts handshakes in progress.
+// Established connections are closed after their queued frames are written.
+// Close returns when all server goroutines are done.
 func (s *Server) Close() {
-	s.listener.Close()
+	s.closeOnce.Do(func() {
+		s.listener.Close()
+		s.mu.Lock()
+		s.closed = true
+		for conn := range s.handshakes {
+			conn.Close()
+		}
+		peers := make([]*peerConn, 0, len(s.connections))
+		for _, peer := range s.connections {
+			peer.drain(ErrServerClosed)
+			peers = append(peers, peer)
+		}
+		s.mu.Unlock()
+		// Readers stuck in emit see cancel and close their connection, so
+		// cancel only after queued frames are written.
+		for _, peer := range peers {
+			<-peer.done
+		}
+		s.cancel()
+		s.wg.Wait()
+		s.dumper.Close()
+	})
 }
 
 func (s *Server) MakeNewConnectionTo(uid Uid, endpoint string) error {
-	c, err := net.Dial("tcp", endpoint)
+	_, err := s.dial(uid, endpoint)
+	return err
+}
+
+// ConnectTo connects to endpoint of yet unknown peer, whoever answers there.
+func (s *Server) ConnectTo(endpoint string) (ConnectInfo, error) {
+	return s.dial("", endpoint)
+}
+
+// dial makes connection to the peer with uid, any peer if uid is empty.
+func (s *Server) dial(uid Uid, endpoint string) (ConnectInfo, error) {
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	raw, err := dialer.Dial("tcp", endpoint)
 	if err != nil {
-		s.log.Warningf("%w", err)
-		return err
+		s.log.Warningf("%s", err)
+		return ConnectInfo{}, err
+	}
+	c := tls.Client(raw, s.tlsConfig)
+	cert_uid, cert_key, err := s.tlsHandshake(c)
+	if err != nil {
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("TLS handshake with %s failed, peer may run protocol older than %d: %w", endpoint, tlsProtocolVersion, err)
 	}
 
 	s.log.Debugf("Connected to %s", c.RemoteAddr().String())
 
-	s.connections[uid] = c
-	go s.handleUserConnectoin(c, s.NewEvent)
+	own := newConnectInfo(s.own_info, s.identity)
+	err = s.writeHandshake(c, own)
+	if err != nil {
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("Cannot send ConnectInfo msg: %w", err)
+	}
 
-	conn_info := ConnectInfo{MyUid: s.own_info.Uid, MyName: s.own_info.Name}
-	err = SendTo(s, uid, conn_info)
+	reader := s.newHandshakeReader(c)
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	hdr, payload, err := reader.ReadFrame()
 	if err != nil {
-		s.log.Warningf("Cannot send ConnectInfo msg: %s", err)
-		return err
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("No handshake answer from %s: %w", endpoint, err)
+	}
+	c.SetReadDeadline(time.Time{})
+
+	refuse_id, _ := GetTypeId(ConnectRefused{})
+	if hdr.MsgType == refuse_id {
+		refused, _ := DecodeMsg[ConnectRefused](payload)
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("%w by %s: %s", ErrConnectionRefused, endpoint, refused.Reason)
+	}
+	peer_info, err := DecodeMsg[ConnectInfo](payload)
+	if err != nil {
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("Cannot decode ConnectInfo answer: %w", err)
+	}
+	err = checkPeerIdentity(peer_info, cert_uid, cert_key)
+	if err == nil && peer_info.MyUid == s.own_info.Uid {
+		err = errors.New("Cannot connect to self")
 	}
-	return nil
+	if err == nil {
+		err = s.admitPeer(peer_info)
+	}
+	if err != nil {
+		s.refuse(c, err.Error())
+		return ConnectInfo{}, err
+	}
+	if uid != "" && peer_info.MyUid != uid {
+		c.Close()
+		return ConnectInfo{}, fmt.Errorf("Expected %s on %s, but %s(%s) answered", uid, endpoint, peer_info.MyName, peer_info.MyUid)
+	}
+	protocol, err := negotiateProtocol(own, peer_info)
+	if err != nil {
+		s.refuse(c, err.Error())
+		return ConnectInfo{}, err
+	}
+
+	peer := newPeerConn(c, reader, peer_info, protocol, s.config, s.dumper)
+	peer.outgoing = true
+	s.addConnection(peer)
+	return peer_info, nil
 }
 
 func (s *Server) acceptLoop() {
 	for {
 		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
-			s.log.Warningf("Cannot accept connection: ", err)
+			s.log.Warningf("Cannot accept connection: %s", err)
 			continue
 		}
 		s.log.Debugf("Accept connection from %s", conn.RemoteAddr().String())
 
-		_, msg, err := s.readMessage(conn)
-		if err != nil {
-			s.log.Errorf("Failed to read message: %s, abort", err)
+		if !s.trackHandshake(conn, true) {
 			conn.Close()
 			return
 		}
-		conn_info, err := DecodeMsg[ConnectInfo](msg.Payload)
-		if err != nil {
-			s.log.Errorf("Failed to accept ConnectInfo message: %s, abort", err)
-			conn.Close()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.trackHandshake(conn, false)
+			s.acceptHandshake(conn)
+		}()
+	}
+}
+
+// trackHandshake adds or removes connection from handshakes. It returns
+// false if the server is closed.
+func (s *Server) trackHandshake(conn net.Conn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.handshakes, conn)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.handshakes[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) acceptHandshake(raw net.Conn) {
+	raw.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	buffered := bufio.NewReader(raw)
+	head, err := buffered.Peek(3)
+	if err != nil {
+		s.log.Errorf("Nothing received from %s: %s, abort", raw.RemoteAddr().String(), err)
+		raw.Close()
+		return
+	}
+	peeked := &peekedConn{Conn: raw, r: buffered}
+	if !isTlsRecord(head) {
+		s.refusePlain(peeked)
+		return
+	}
+
+	var conn net.Conn = tls.Server(peeked, s.tlsConfig)
+	cert_uid, cert_key, err := s.tlsHandshake(conn.(*tls.Conn))
+	if err != nil {
+		s.log.Errorf("TLS handshake with %s failed: %s, abort", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	reader := s.newHandshakeReader(conn)
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, payload, err := reader.ReadFrame()
+	if err != nil {
+		s.log.Errorf("Failed to read handshake from %s: %s, abort", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	conn_info, err := DecodeMsg[ConnectInfo](payload)
+	if err != nil {
+		s.log.Errorf("Failed to accept ConnectInfo message: %s, abort", err)
+		conn.Close()
+		return
+	}
+
+	s.log.Debugf("Get ConnectInfo msg from %s", conn_info.MyName)
+	err = checkPeerIdentity(conn_info, cert_uid, cert_key)
+	if err == nil {
+		err = s.admitPeer(conn_info)
+	}
+	if err != nil {
+		s.refuse(conn, err.Error())
+		return
+	}
+
+	own := newConnectInfo(s.own_info, s.identity)
+	protocol, err := negotiateProtocol(own, conn_info)
+	if err != nil {
+		s.refuse(conn, err.Error())
+		return
+	}
+	err = s.writeHandshake(conn, own)
+	if err != nil {
+		s.log.Errorf("Cannot answer ConnectInfo to %s: %s", conn_info.MyName, err)
+		conn.Close()
+		return
+	}
+
+	s.addConnection(newPeerConn(conn, reader, conn_info, protocol, s.config, s.dumper))
+}
+
+// refusePlain answers peer that connects without TLS, i.e. runs protocol
+// older than tlsProtocolVersion. Handshake frames keep their layout, so the
+// peer reads ConnectRefused and logs the reason.
+func (s *Server) refusePlain(conn net.Conn) {
+	_, payload, err := s.newHandshakeReader(conn).ReadFrame()
+	if err == nil {
+		info, err := DecodeMsg[ConnectInfo](payload)
+		if err == nil {
+			s.log.Infof("%s(%s) connects with protocol version %d without TLS", info.MyName, info.MyUid, info.MaxVersion)
+		}
+	}
+	s.refuse(conn, fmt.Sprintf("Connection without TLS, protocol version %d or newer is required", tlsProtocolVersion))
+}
+
+// isTlsRecord tells TLS ClientHello from ConnectInfo frame of older peer. Both
+// start with 3 bytes: record type 0x16 and version 0x03 0x01-0x04 for TLS,
+// little endian payload size for the frame. Frame of 0x16 0x03 0x01.. would
+// be ConnectInfo of 66 kB.
+func isTlsRecord(head []byte) bool {
+	return head[0] == 0x16 && head[1] == 0x03 && head[2] >= 0x01
+}
+
+// peekedConn is connection whose first bytes were already read into r.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (s *Server) tlsHandshake(conn *tls.Conn) (Uid, ed25519.PublicKey, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err := conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		return "", nil, err
+	}
+	return peerIdentity(conn.ConnectionState())
+}
+
+func (s *Server) addConnection(peer *peerConn) {
+	s.log.Debugf("Handshake with %s done, protocol version %d, codec %s, features %v",
+		peer.info.MyName, peer.protocol.Version, peer.protocol.Codec.Name(), peer.protocol.Features)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		peer.close(ErrServerClosed)
+		return
+	}
+	prev, ok := s.connections[peer.info.MyUid]
+	replaced := errors.New("Replaced by new connection")
+	if ok && prev.outgoing != peer.outgoing {
+		// Both sides dialed each other at once. Each side keeps connection
+		// dialed by the lower Uid, so both keep the same one.
+		if s.dialerOf(peer) > s.dialerOf(prev) {
+			s.mu.Unlock()
+			s.log.Debugf("Drop duplicate connection with %s", peer.info.MyName)
+			peer.close(ErrDuplicateConnection)
 			return
 		}
+		replaced = ErrDuplicateConnection
+	}
+	s.connections[peer.info.MyUid] = peer
+	// Added under the lock, so Close either waits for these goroutines or
+	// the connection is not added at all.
+	s.wg.Add(2)
+	s.mu.Unlock()
+	if ok {
+		prev.close(replaced)
+	}
+	go func() {
+		defer s.wg.Done()
+		peer.writeLoop()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.handleUserConnectoin(peer)
+	}()
+}
+
+// dialerOf returns uid of the side that dialed the connection.
+func (s *Server) dialerOf(peer *peerConn) Uid {
+	if peer.outgoing {
+		return s.own_info.Uid
+	}
+	return peer.info.MyUid
+}
+
+func (s *Server) dropConnection(peer *peerConn, reason error) {
+	peer.close(reason)
+	s.mu.Lock()
+	current := s.connections[peer.info.MyUid] == peer
+	if current {
+		delete(s.connections, peer.info.MyUid)
+	}
+	s.mu.Unlock()
+	if current {
+		s.emit(PeerDisconnected{Uid: peer.info.MyUid, Name: peer.info.MyName, Reason: peer.reason()})
+	}
+}
+
+func (s *Server) refuse(c net.Conn, reason string) {
+	s.log.Warningf("Refuse connection with %s: %s", c.RemoteAddr().String(), reason)
+	s.writeHandshake(c, ConnectRefused{Reason: reason})
+	c.Close()
+}
 
-		s.log.Debugf("Get ConnectInfo msg from %s", conn_info.MyName)
+// Handshake frames always use DefaultCodec and HandshakeVersion layout, since
+// neither is negotiated yet.
+func (s *Server) writeHandshake(c net.Conn, msg any) error {
+	bytes, err := EncodeMsgWith(DefaultCodec, HandshakeVersion, msg)
+	if err != nil {
+		return err
+	}
+	frame := EncodeFrame(bytes)
+	s.dumper.Dump(DumpOut, "", c.RemoteAddr().String(), DefaultCodec, HandshakeVersion, frame)
+	_, err = c.Write(frame)
+	return err
+}
 
-		s.connections[conn_info.MyUid] = conn
-		go s.handleUserConnectoin(conn, s.NewEvent)
+func (s *Server) newHandshakeReader(c net.Conn) *FrameReader {
+	reader := NewFrameReader(c, s.config.MaxFrameSize)
+	reader.Version = HandshakeVersion
+	if s.dumper != nil {
+		reader.OnFrame = func(frame []byte) {
+			s.dumper.Dump(DumpIn, "", c.RemoteAddr().String(), DefaultCodec, HandshakeVersion, frame)
+		}
 	}
+	return reader
 }
 
-func (s *Server) handleUserConnectoin(c net.Conn, newEvent chan interface{}) {
+func (s *Server) handleUserConnectoin(peer *peerConn) {
+	var closeReason error
+	defer func() { s.dropConnection(peer, closeReason) }()
+	if !s.emit(PeerConnected{Uid: peer.info.MyUid, Name: peer.info.MyName}) {
+		closeReason = ErrServerClosed
+		return
+	}
+	codec := peer.protocol.Codec
 	for {
-		hdr, msg, err := s.readMessage(c)
+		hdr, payload, err := peer.reader.ReadFrame()
+		if errors.Is(err, ErrBadChecksum) {
+			// Frame boundaries are still fine, only this payload is damaged.
+			s.log.Warningf("Drop frame from %s: %s", peer.info.MyName, err)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			s.log.Infof("Connection with %s closed", peer.info.MyName)
+			closeReason = err
+			return
+		}
 		if err != nil {
-			s.log.Errorf("%s", err)
+			s.log.Errorf("Close connection with %s: %s", peer.info.MyName, err)
+			closeReason = err
 			return
 		}
-		s.log.Tracef("Got message of type %d", hdr.MsgType)
-		var ev interface{}
-
-		switch hdr.MsgType {
-		case 1:
-			ev, err = DecodeMsg[NodeAnnounce](msg.Payload)
-		case 2:
-			ev, err = DecodeMsg[InviteForJoin](msg.Payload)
-			if err == nil && ev == nil {
-				s.log.Warningf("Ev is NIL!!!!!!!!")
+		s.log.Tracef("Got message of type %s", GetTypeName(hdr.MsgType))
+		response := hdr.Flags&FlagResponse != 0
+		err = peer.limiter.allow(hdr.MsgType, response, len(payload), time.Now())
+		if err != nil {
+			s.log.Warningf("Drop %s from %s: %s", GetTypeName(hdr.MsgType), peer.info.MyName, err)
+			if peer.limiter.shouldBan() {
+				s.ban(peer)
+				closeReason = ErrBanned
 				return
 			}
-		case 3:
-			ev, err = DecodeMsg[JoinChat](msg.Payload)
-		case 4:
-			ev, err = DecodeMsg[ChatMessage](msg.Payload)
-		case 5:
-			ev, err = DecodeMsg[ConnectInfo](msg.Payload)
-		case 6:
-			ev, err = DecodeMsg[WatchedCids](msg.Payload)
-		case 7:
-			ev, err = DecodeMsg[HaveCidInfo](msg.Payload)
-		case 8:
-			ev, err = DecodeMsg[MessagesRequest](msg.Payload)
-		case 9:
-			ev, err = DecodeMsg[ChatMessagePack](msg.Payload)
+			continue
+		}
+
+		ev, err := registry.decode(codec, hdr.MsgType, payload)
+		if errors.Is(err, ErrUnknownMsgType) {
+			// Peer may run newer protocol with message types we don't know yet.
+			// Payload is already consumed, so just skip it.
+			s.log.Warningf("Skip message of unknown type %d", hdr.MsgType)
+			continue
 		}
 		if err != nil {
-			s.log.Warningf("Cannot decode message of type %d, bytes: %s", hdr.MsgType, msg.Payload)
+			s.log.Warningf("Cannot decode message of type %d, bytes: %s", hdr.MsgType, payload)
+			closeReason = err
 			return
 		}
-		if ev == nil {
-			s.log.Warningf("Decode return no error, but ev is nil")
+		if response {
+			if !peer.resolvePending(hdr.RequestId, ev) {
+				s.log.Debugf("Drop late reply %d from %s", hdr.RequestId, peer.info.MyName)
+			}
+			continue
+		}
+		if !s.emit(NetEvent{From: peer.info.MyUid, RequestId: hdr.RequestId, Msg: ev}) {
+			closeReason = ErrServerClosed
 			return
 		}
-		newEvent <- ev
-	}
-}
-
-func (s *Server) readMessage(c net.Conn) (MsgHeader, *MsgBytes, error) {
-	msg := NewMsgBytes()
-	n, err := c.Read(msg.Header)
-	if err != nil {
-		return MsgHeader{}, nil, err
 	}
-	if n < 6 {
-		return MsgHeader{}, msg, errors.New("Not enought header!!!")
-	}
-	hdr, err := DecodeHeader(msg.Header)
-	msg.Payload = make([]byte, hdr.PayloadSize)
-	n, err = c.Read(msg.Payload)
-	if err != nil {
-		return hdr, msg, err
-	}
-	if n != int(hdr.PayloadSize) {
-		s.log.Errorf("Not enought payload!!!")
-		return hdr, msg, err
-	}
-
-	return hdr, msg, nil
 }
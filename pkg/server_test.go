@@ -0,0 +1,302 @@
+package glink
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/juju/loggo"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T, name string) (*Server, chan interface{}) {
+	logger := loggo.GetLogger("default")
+	identity := newTestIdentity(t)
+	s, err := NewServer(UserLightInfo{Uid: identity.Uid(), Name: name}, identity, DefaultServerConfig(), &logger)
+	require.Nil(t, err)
+	events := make(chan interface{}, 10)
+	s.Run(events)
+	t.Cleanup(s.Close)
+	return s, events
+}
+
+// writeHandshake sends msg the way handshake frames are sent.
+func writeHandshake(t *testing.T, c net.Conn, msg any) {
+	bytes, err := EncodeMsgWith(DefaultCodec, HandshakeVersion, msg)
+	require.Nil(t, err)
+	_, err = c.Write(EncodeFrame(bytes))
+	require.Nil(t, err)
+}
+
+func readHandshake(c net.Conn) (MsgHeader, []byte, error) {
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reader := NewFrameReader(c, DefaultMaxFrameSize)
+	reader.Version = HandshakeVersion
+	return reader.ReadFrame()
+}
+
+func TestServerRequestReply(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	bob, bobEvents := newTestServer(t, "bob")
+
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	require.True(t, alice.SupportsFeature(bob.own_info.Uid, FeatureSync))
+	require.IsType(t, PeerConnected{}, <-bobEvents)
+
+	go func() {
+		ev := (<-bobEvents).(NetEvent)
+		req := ev.Msg.(WatchedCids)
+		bob.Reply(ev.From, ev.RequestId, HaveCidInfo{From: "bob", To: ev.From, ChatsVectorClock: map[Cid]VectorClock{req.Cids[0]: {"bob": 3}}})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	info, err := Request[HaveCidInfo](ctx, alice, bob.own_info.Uid, WatchedCids{From: "alice", To: "bob", Cids: []Cid{"cid"}})
+	require.Nil(t, err)
+	require.Equal(t, uint32(3), info.ChatsVectorClock["cid"]["bob"])
+}
+
+func TestServerRequestNeedsRequestId(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	c, _ := net.Pipe()
+	defer c.Close()
+	old := Protocol{Version: 3, Codec: DefaultCodec}
+	alice.connections["bob"] = newPeerConn(c, NewFrameReader(c, 0), ConnectInfo{MyUid: "bob", MyName: "bob"}, old, alice.config, nil)
+	// Nobody runs writeLoop of this peer, so Close must not wait for it.
+	defer delete(alice.connections, "bob")
+
+	_, err := alice.Request(context.Background(), "bob", WatchedCids{From: "alice", To: "bob"})
+	require.ErrorIs(t, err, ErrNoRequestId)
+}
+
+func TestServerRequestTimeout(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	bob, _ := newTestServer(t, "bob")
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := alice.Request(ctx, bob.own_info.Uid, WatchedCids{From: "alice", To: "bob"})
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestServerConcurrentSendersAndDisconnect(t *testing.T) {
+	alice, aliceEvents := newTestServer(t, "alice")
+	bob, bobEvents := newTestServer(t, "bob")
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	require.Equal(t, PeerConnected{Uid: bob.own_info.Uid, Name: "bob"}, <-aliceEvents)
+	require.Equal(t, PeerConnected{Uid: alice.own_info.Uid, Name: "alice"}, <-bobEvents)
+
+	const senders, perSender = 4, 10
+	for i := 0; i < senders; i++ {
+		go func(i int) {
+			for j := 0; j < perSender; j++ {
+				alice.SendTo(bob.own_info.Uid, ChatMessage{Uid: "alice", Cid: "cid", Index: uint32(i*perSender + j), Text: "text"})
+			}
+		}(i)
+	}
+	seen := make(map[uint32]bool)
+	for len(seen) < senders*perSender {
+		select {
+		case ev := <-bobEvents:
+			seen[ev.(NetEvent).Msg.(ChatMessage).Index] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got only %d messages", len(seen))
+		}
+	}
+
+	bob.Close()
+	bob.mu.Lock()
+	for _, peer := range bob.connections {
+		peer.close(nil)
+	}
+	bob.mu.Unlock()
+	select {
+	case ev := <-aliceEvents:
+		require.Equal(t, bob.own_info.Uid, ev.(PeerDisconnected).Uid)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No disconnect event")
+	}
+	require.NotNil(t, alice.SendTo(bob.own_info.Uid, ChatMessage{}))
+}
+
+func TestServerRefusesUidNotMatchingCertificate(t *testing.T) {
+	bob, _ := newTestServer(t, "bob")
+	alice := newTestIdentity(t)
+	mallory := newTestIdentity(t)
+	config, err := newTlsConfig(UserLightInfo{Uid: mallory.Uid()}, mallory)
+	require.Nil(t, err)
+	c, err := tls.Dial("tcp", bob.ListenerAddress(), config)
+	require.Nil(t, err)
+	defer c.Close()
+
+	writeHandshake(t, c, newConnectInfo(UserLightInfo{Uid: alice.Uid(), Name: "alice"}, mallory))
+	hdr, _, err := readHandshake(c)
+	require.Nil(t, err)
+	refuse_id, _ := GetTypeId(ConnectRefused{})
+	require.Equal(t, refuse_id, hdr.MsgType)
+	require.False(t, bob.SupportsFeature(alice.Uid(), FeatureSync))
+}
+
+func TestServerRefusesCertificateForOtherUid(t *testing.T) {
+	bob, _ := newTestServer(t, "bob")
+	alice := newTestIdentity(t)
+	mallory := newTestIdentity(t)
+	config, err := newTlsConfig(UserLightInfo{Uid: alice.Uid()}, mallory)
+	require.Nil(t, err)
+	c, err := tls.Dial("tcp", bob.ListenerAddress(), config)
+	require.Nil(t, err)
+	defer c.Close()
+
+	writeHandshake(t, c, newConnectInfo(UserLightInfo{Uid: alice.Uid(), Name: "alice"}, mallory))
+	_, _, err = readHandshake(c)
+	require.NotNil(t, err)
+	require.False(t, bob.SupportsFeature(alice.Uid(), FeatureSync))
+}
+
+func TestServerRefusesOldVersionReadably(t *testing.T) {
+	bob, _ := newTestServer(t, "bob")
+	alice := newTestIdentity(t)
+	config, err := newTlsConfig(UserLightInfo{Uid: alice.Uid()}, alice)
+	require.Nil(t, err)
+	c, err := tls.Dial("tcp", bob.ListenerAddress(), config)
+	require.Nil(t, err)
+	defer c.Close()
+
+	// Peer of version 1 reads only 6 byte headers.
+	old := newConnectInfo(UserLightInfo{Uid: alice.Uid(), Name: "alice"}, alice)
+	old.MinVersion, old.MaxVersion = 1, 1
+	writeHandshake(t, c, old)
+	hdr, payload, err := readHandshake(c)
+	require.Nil(t, err)
+	refuse_id, _ := GetTypeId(ConnectRefused{})
+	require.Equal(t, refuse_id, hdr.MsgType)
+	refused, err := DecodeMsg[ConnectRefused](payload)
+	require.Nil(t, err)
+	require.Contains(t, refused.Reason, "No common protocol version")
+}
+
+func TestServerRejectsPlainConnection(t *testing.T) {
+	bob, _ := newTestServer(t, "bob")
+	c, err := net.Dial("tcp", bob.ListenerAddress())
+	require.Nil(t, err)
+	defer c.Close()
+
+	// Peer of version 1 runs plain TCP, but still gets readable refusal.
+	writeHandshake(t, c, ConnectInfo{MyUid: "alice", MinVersion: 1, MaxVersion: 1})
+	hdr, payload, err := readHandshake(c)
+	require.Nil(t, err)
+	refuse_id, _ := GetTypeId(ConnectRefused{})
+	require.Equal(t, refuse_id, hdr.MsgType)
+	refused, err := DecodeMsg[ConnectRefused](payload)
+	require.Nil(t, err)
+	require.Contains(t, refused.Reason, "without TLS")
+	require.False(t, bob.SupportsFeature("alice", FeatureSync))
+}
+
+func TestServerConnectToLearnsPeer(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	bob, _ := newTestServer(t, "bob")
+
+	info, err := alice.ConnectTo(bob.ListenerAddress())
+	require.Nil(t, err)
+	require.Equal(t, bob.own_info.Uid, info.MyUid)
+	require.Equal(t, "bob", info.MyName)
+	require.True(t, alice.SupportsFeature(bob.own_info.Uid, FeatureSync))
+
+	_, err = alice.ConnectTo(alice.ListenerAddress())
+	require.NotNil(t, err)
+}
+
+func TestServerCloseDeliversQueuedFrames(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	bob, bobEvents := newTestServer(t, "bob")
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	require.IsType(t, PeerConnected{}, <-bobEvents)
+
+	const count = 20
+	for i := 0; i < count; i++ {
+		require.Nil(t, alice.SendTo(bob.own_info.Uid, ChatMessage{Uid: "alice", Cid: "cid", Index: uint32(i)}))
+	}
+	alice.Close()
+	require.NotNil(t, alice.SendTo(bob.own_info.Uid, ChatMessage{}))
+
+	for i := 0; i < count; i++ {
+		select {
+		case ev := <-bobEvents:
+			require.Equal(t, uint32(i), ev.(NetEvent).Msg.(ChatMessage).Index)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got only %d messages", i)
+		}
+	}
+	select {
+	case ev := <-bobEvents:
+		require.Equal(t, alice.own_info.Uid, ev.(PeerDisconnected).Uid)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No disconnect event")
+	}
+}
+
+func TestServerSimultaneousDialsKeepOneConnection(t *testing.T) {
+	alice, _ := newTestServer(t, "alice")
+	bob, bobEvents := newTestServer(t, "bob")
+	errs := make(chan error, 2)
+	go func() { errs <- alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()) }()
+	go func() { errs <- bob.MakeNewConnectionTo(alice.own_info.Uid, alice.ListenerAddress()) }()
+	require.Nil(t, <-errs)
+	require.Nil(t, <-errs)
+
+	lower := alice
+	if bob.own_info.Uid < alice.own_info.Uid {
+		lower = bob
+	}
+	// Both sides keep the connection dialed by the lower Uid.
+	keeps := func(s *Server, uid Uid) bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		peer, ok := s.connections[uid]
+		return ok && peer.outgoing == (s == lower)
+	}
+	require.Eventually(t, func() bool {
+		return keeps(alice, bob.own_info.Uid) && keeps(bob, alice.own_info.Uid)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Nil(t, alice.SendTo(bob.own_info.Uid, ChatMessage{Index: 7}))
+	for {
+		select {
+		case ev := <-bobEvents:
+			if ev, ok := ev.(NetEvent); ok {
+				require.Equal(t, uint32(7), ev.Msg.(ChatMessage).Index)
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No message over kept connection")
+		}
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	alice, aliceEvents := newTestServer(t, "alice")
+	bob, bobEvents := newTestServer(t, "bob")
+	carol, _ := newTestServer(t, "carol")
+	require.Nil(t, alice.MakeNewConnectionTo(bob.own_info.Uid, bob.ListenerAddress()))
+	require.Nil(t, alice.MakeNewConnectionTo(carol.own_info.Uid, carol.ListenerAddress()))
+	require.IsType(t, PeerConnected{}, <-aliceEvents)
+	require.IsType(t, PeerConnected{}, <-aliceEvents)
+	require.IsType(t, PeerConnected{}, <-bobEvents)
+
+	require.Nil(t, alice.SendToAll(ChatMessage{Index: 1}, func(uid Uid) bool { return uid == carol.own_info.Uid }))
+	require.Equal(t, uint32(1), (<-bobEvents).(NetEvent).Msg.(ChatMessage).Index)
+
+	alice.Disconnect(bob.own_info.Uid, ErrBlocked)
+	select {
+	case ev := <-aliceEvents:
+		require.ErrorIs(t, ev.(PeerDisconnected).Reason, ErrBlocked)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No disconnect event")
+	}
+	require.NotNil(t, alice.SendTo(bob.own_info.Uid, ChatMessage{}))
+	require.Nil(t, alice.SendTo(carol.own_info.Uid, ChatMessage{}))
+}
@@ -2,30 +2,69 @@ package glink
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/atomic"
 
 	"github.com/google/uuid"
 	"github.com/juju/loggo"
+	"golang.org/x/term"
+)
+
+var ErrBlocked = errors.New("Blocked user")
+
+const (
+	syncTimeout    = 10 * time.Second
+	syncAttempts   = 3
+	syncRetryDelay = 2 * time.Second
+	// inviteExpiry is how long we wait for JoinChat after InviteForJoin.
+	inviteExpiry = 24 * time.Hour
 )
 
 type GlinkService struct {
 	discovery       IDiscovery
-	discoveryEvents chan DiscoveryInfo
+	discoveryEvents chan interface{}
 	server          IServer
 	serverEvents    chan interface{}
-	Db              *Db
-	stop            chan bool
-	OwnInfo         UserLightInfo
-	UxEvents        chan interface{}
-	log             *loggo.Logger
-	connCandidate   map[string]DiscoveryInfo
-	currMsgIndex    map[Cid]atomic.Uint32
+	// commands run on the service goroutine, see runCommand.
+	commands chan func()
+	// dials are results of connections made by address, see dialAddress.
+	dials         chan dialResult
+	Db            *Db
+	OwnInfo       UserLightInfo
+	identity      *Identity
+	UxEvents      chan interface{}
+	log           *loggo.Logger
+	connCandidate map[string]DiscoveryInfo
+	// staticPeers are uids of peers connected by PeerAddress events.
+	staticPeers map[string]Uid
+	// dialing are endpoints dialAddress connects to right now.
+	dialing      map[string]bool
+	presence     map[Uid]*nodePresence
+	currMsgIndex map[Cid]atomic.Uint32
+	// keyWarnings are uids the user was warned about by KeyChangeWarning and
+	// did not answer yet. They are refused silently, so that every announce
+	// does not bring the warning back. Rejection is not persisted, see
+	// RejectKeyChange.
+	keyWarningsMu sync.Mutex
+	keyWarnings   map[Uid]bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// spawnMu orders spawn and Stop, so that wg.Add never races with
+	// wg.Wait.
+	spawnMu  sync.Mutex
+	wg       sync.WaitGroup
+	stopOnce sync.Once
 }
 
 func readName() string {
@@ -35,35 +74,104 @@ func readName() string {
 	return text[:len(text)-1]
 }
 
-func NewGlinkService(log *loggo.Logger, dbPath string) (*GlinkService, error) {
-	db, err := NewDb(dbPath)
+const passphraseAttempts = 3
+
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	return string(pass), err
+}
+
+// openDb opens db and asks for passphrase if it is encrypted.
+func openDb(path string) (*Db, error) {
+	db, err := NewDb(path)
+	if err != nil {
+		return nil, err
+	}
+	if !db.IsEncrypted() {
+		return db, nil
+	}
+	for attempt := 1; ; attempt++ {
+		pass, err := readPassphrase("Enter passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		err = db.Unlock(pass)
+		if err == nil {
+			return db, nil
+		}
+		if attempt == passphraseAttempts {
+			return nil, err
+		}
+		fmt.Println(err)
+	}
+}
+
+// ChangeDbPassphrase asks for the new passphrase and reencrypts db with it.
+// It also encrypts plain text db of older versions. Empty passphrase turns
+// encryption off.
+func ChangeDbPassphrase(path string) error {
+	db, err := openDb(path)
+	if err != nil {
+		return err
+	}
+	pass, err := readPassphrase("New passphrase (empty to disable encryption): ")
+	if err != nil {
+		return err
+	}
+	repeat, err := readPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return err
+	}
+	if pass != repeat {
+		return errors.New("Passphrases do not match")
+	}
+	return db.ChangePassphrase(pass)
+}
+
+func NewGlinkService(log *loggo.Logger, config Config) (*GlinkService, error) {
+	db, err := openDb(config.DbPath)
 	if err != nil {
 		return nil, err
 	}
 
+	identity, err := LoadIdentity(db)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load identity: %w", err)
+	}
 	ownInfo := db.own_info
 	if ownInfo.Uid == "" {
-		err = db.SetOwnUid(Uid(uuid.New().String()))
+		err = db.SetOwnUid(identity.Uid())
 		if err != nil {
 			return nil, err
 		}
-		ownInfo.Uid = db.GetOwnInfo().Uid
+	} else if ownInfo.Uid != identity.Uid() {
+		log.Warningf("Replace random uid %s with %s derived from identity key", ownInfo.Uid, identity.Uid())
+		err = db.ChangeOwnUid(identity.Uid())
+		if err != nil {
+			return nil, fmt.Errorf("Cannot change own uid: %w", err)
+		}
 	}
+	ownInfo = db.GetOwnInfo()
 	if ownInfo.Name == "" {
 		ownInfo.Name = readName()
 		db.SetOwnName(ownInfo.Name)
 	}
-	server, err := NewServer(ownInfo, log)
+	server, err := NewServer(ownInfo, identity, config.Server, log)
 	if err != nil {
 		return nil, err
 	}
-	own_announce := NodeAnnounce{Uid: ownInfo.Uid, Name: ownInfo.Name, Endpoint: server.ListenerAddress()}
+	own_announce := identity.SignAnnounce(NodeAnnounce{Uid: ownInfo.Uid, Name: ownInfo.Name, Endpoint: server.ListenerAddress()})
 
 	log.Infof("Mine info. %s(%s): %s", own_announce.Name, own_announce.Uid, own_announce.Endpoint)
 
-	discovery := NewDiscovery(own_announce, log)
+	discovery, err := NewDiscoveryBackend(own_announce, config.Discovery, log)
+	if err != nil {
+		return nil, err
+	}
 
-	return createService(log, db, server, discovery, ownInfo)
+	return createService(log, db, server, discovery, ownInfo, identity)
 }
 
 func createService(
@@ -72,43 +180,103 @@ func createService(
 	server IServer,
 	discovery IDiscovery,
 	ownInfo UserLightInfo,
+	identity *Identity,
 ) (*GlinkService, error) {
 	out := &GlinkService{
 		discovery:       discovery,
-		discoveryEvents: make(chan DiscoveryInfo),
+		discoveryEvents: make(chan interface{}),
 		server:          server,
 		serverEvents:    make(chan interface{}),
-		stop:            make(chan bool),
+		commands:        make(chan func(), 16),
+		dials:           make(chan dialResult),
 		Db:              db,
 		OwnInfo:         ownInfo,
+		identity:        identity,
 		UxEvents:        make(chan interface{}, 2),
 		log:             log,
 		connCandidate:   make(map[string]DiscoveryInfo),
+		staticPeers:     make(map[string]Uid),
+		dialing:         make(map[string]bool),
+		presence:        make(map[Uid]*nodePresence),
 		currMsgIndex:    make(map[Cid]atomic.Uint32),
+		keyWarnings:     make(map[Uid]bool),
 	}
+	out.ctx, out.cancel = context.WithCancel(context.Background())
 	err := discovery.Run(out.discoveryEvents)
 	if err != nil {
 		return nil, err
 	}
+	server.SetAdmission(out.admitPeer)
 	server.Run(out.serverEvents)
 	return out, nil
 }
 
-func (g *GlinkService) Stop() {
-	g.stop <- true
+// Stop shuts the service down: discovery stops, peer connections are closed
+// after their queued frames are sent and Db is closed. It returns when all
+// service goroutines are done.
+func (g *GlinkService) Stop() error {
+	var err error
+	g.stopOnce.Do(func() {
+		g.spawnMu.Lock()
+		g.cancel()
+		g.spawnMu.Unlock()
+		g.discovery.Close()
+		g.server.Close()
+		g.wg.Wait()
+		err = g.Db.Close()
+	})
+	return err
 }
 
 func (g *GlinkService) Launch() {
-	go g.serve()
+	g.spawn(g.serve)
 }
 
+// spawn runs fn in goroutine Stop waits for. Nothing is run after Stop.
+func (g *GlinkService) spawn(fn func()) {
+	g.spawnMu.Lock()
+	defer g.spawnMu.Unlock()
+	if g.ctx.Err() != nil {
+		return
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		fn()
+	}()
+}
+
+// emit passes event to UX unless the service is stopped.
+func (g *GlinkService) emit(ev interface{}) {
+	select {
+	case g.UxEvents <- ev:
+	case <-g.ctx.Done():
+	}
+}
+
+// runCommand runs fn later on the service goroutine. Everything UI asks for
+// goes this way, since it uses the service state and may wait for network.
+func (g *GlinkService) runCommand(fn func()) {
+	select {
+	case g.commands <- fn:
+	case <-g.ctx.Done():
+	}
+}
+
+// UserMessage sends message to the chat. Text starting with ! is a command,
+// see processCommand.
 func (g *GlinkService) UserMessage(msg ChatMessage) error {
 	if msg.Text[0] == '!' {
-		g.processCommand(msg.Text[1:])
+		cmd := msg.Text[1:]
+		g.runCommand(func() { g.processCommand(cmd) })
 		return nil
 	}
 	g.log.Tracef("Send msg to cid %s", msg.Cid)
 	msg.Uid = g.OwnInfo.Uid
+	key, err := g.chatKey(msg.Cid)
+	if err != nil {
+		return err
+	}
 
 	index, ok := g.currMsgIndex[msg.Cid]
 	if !ok {
@@ -127,22 +295,158 @@ func (g *GlinkService) UserMessage(msg ChatMessage) error {
 
 	g.currMsgIndex[msg.Cid] = index
 
-	err := g.Db.SaveMessage(msg)
+	text := msg.Text
+	msg.Sealed, err = SealText(text, key)
+	if err != nil {
+		return fmt.Errorf("Cannot encrypt message: %w", err)
+	}
+	msg.Text = ""
+	msg = g.identity.SignMessage(msg)
+
+	err = g.Db.SaveMessage(msg)
 	if err != nil {
 		g.log.Warningf("Cannot save messages: %s", err)
 	}
 
-	err = SendToAll(g.server, msg)
+	err = g.server.SendToAll(msg, g.Db.IsBlocked)
 	if err != nil {
 		g.log.Warningf("cannot send to all: %s", err)
 		return err
 	}
-	g.UxEvents <- msg
+	msg.Text = text
+	g.emit(msg)
+	return nil
+}
+
+// AcceptKeyChange saves uid of KeyChangeWarning as one more contact after
+// user confirmed it is not an impostor. The known contact with the same name
+// is kept.
+func (g *GlinkService) AcceptKeyChange(warning KeyChangeWarning) {
+	g.runCommand(func() {
+		err := g.acceptKeyChange(warning)
+		if err != nil {
+			g.log.Errorf("Cannot accept new key of %s: %s", warning.Name, err)
+		}
+	})
+}
+
+func (g *GlinkService) acceptKeyChange(warning KeyChangeWarning) error {
+	g.log.Warningf("Accept %s(%s) with identity key %s", warning.Name, warning.Uid, Fingerprint(warning.NewKey))
+	err := g.Db.SaveNewUid(warning.Uid, warning.Name, "")
+	if err != nil {
+		return err
+	}
+	err = g.Db.PinIdentityKey(warning.Uid, warning.NewKey)
+	if err != nil {
+		return err
+	}
+	g.keyWarningsMu.Lock()
+	delete(g.keyWarnings, warning.Uid)
+	g.keyWarningsMu.Unlock()
 	return nil
 }
 
+// RejectKeyChange is called when user dismissed KeyChangeWarning. The uid is
+// still refused, but it is not remembered: when it shows up again, the user
+// is warned again.
+func (g *GlinkService) RejectKeyChange(warning KeyChangeWarning) {
+	g.runCommand(func() {
+		g.log.Warningf("Reject %s(%s) with identity key %s", warning.Name, warning.Uid, Fingerprint(warning.NewKey))
+		g.keyWarningsMu.Lock()
+		delete(g.keyWarnings, warning.Uid)
+		g.keyWarningsMu.Unlock()
+	})
+}
+
+// admitPeer runs in server goroutines for every connection.
+func (g *GlinkService) admitPeer(info ConnectInfo) error {
+	if g.Db.IsBlocked(info.MyUid) {
+		return fmt.Errorf("%w %s", ErrBlocked, info.MyUid)
+	}
+	return g.checkContactName(info.MyUid, info.MyName, info.IdentityKey)
+}
+
+// checkContactName refuses unknown uid that comes with the name of a known
+// contact: it is likely someone impersonating the contact. Uid is derived
+// from the identity key, so this is also how a changed key of the contact
+// looks. User is warned once and may accept the uid with AcceptKeyChange.
+func (g *GlinkService) checkContactName(uid Uid, name string, key []byte) error {
+	if g.Db.IsKnownUid(uid) {
+		return nil
+	}
+	known, err := g.Db.GetUidsByName(name)
+	if err != nil {
+		return err
+	}
+	if len(known) == 0 {
+		return nil
+	}
+	g.keyWarningsMu.Lock()
+	warned := g.keyWarnings[uid]
+	g.keyWarnings[uid] = true
+	g.keyWarningsMu.Unlock()
+	if !warned {
+		pinned, err := g.Db.GetIdentityKey(known[0])
+		if err != nil {
+			return err
+		}
+		g.log.Errorf("%s(%s) comes with name of known contact %s and key %s, refuse", name, uid, known[0], Fingerprint(key))
+		g.emit(KeyChangeWarning{Uid: uid, Name: name, KnownUid: known[0], PinnedKey: pinned, NewKey: key})
+	}
+	return fmt.Errorf("%w for %s", ErrKeyChanged, name)
+}
+
+// GetMessages returns messages of the chat with decrypted Text.
 func (g *GlinkService) GetMessages(to_cid Cid) ([]ChatMessage, error) {
-	return g.Db.GetMessages(to_cid, 0, 10000000)
+	msgs, err := g.Db.GetMessages(to_cid, 0, 10000000)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]ChatMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		msg, err = g.openMessage(msg)
+		if err != nil {
+			g.log.Warningf("Cannot decrypt message %d of %s in chat %s: %s", msg.Index, msg.Uid, msg.Cid, err)
+			continue
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
+func (g *GlinkService) chatKey(cid Cid) ([]byte, error) {
+	key, err := g.Db.GetChatKey(cid)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%w %s", ErrNoChatKey, cid)
+	}
+	return key, nil
+}
+
+// openMessage fills Text from Sealed. Messages saved before encryption was
+// introduced have no Sealed and are returned as is.
+func (g *GlinkService) openMessage(msg ChatMessage) (ChatMessage, error) {
+	if msg.Sealed == nil {
+		return msg, nil
+	}
+	key, err := g.chatKey(msg.Cid)
+	if err != nil {
+		return msg, err
+	}
+	msg.Text, err = OpenText(msg.Sealed, key)
+	return msg, err
+}
+
+// saveIncoming stores message received from network. Only ciphertext is
+// accepted, so peers cannot put plain text into our history.
+func (g *GlinkService) saveIncoming(msg ChatMessage) error {
+	if msg.Sealed == nil {
+		return errors.New("Message is not encrypted")
+	}
+	msg.Text = ""
+	return g.Db.SaveMessage(msg)
 }
 
 func (g *GlinkService) GetNameByCid(uid Uid) (string, error) {
@@ -154,13 +458,19 @@ func (g *GlinkService) serve() {
 
 	for {
 		select {
-		case new_node := <-g.discoveryEvents:
-			g.processDiscoveryEvent(new_node)
+		case ev := <-g.discoveryEvents:
+			g.processDiscoveryEvent(ev)
 
 		case ev := <-g.serverEvents:
 			g.processNetworkEvent(ev)
 
-		case <-g.stop:
+		case fn := <-g.commands:
+			fn()
+
+		case res := <-g.dials:
+			g.onDialed(res)
+
+		case <-g.ctx.Done():
 			return
 		}
 
@@ -168,149 +478,743 @@ func (g *GlinkService) serve() {
 }
 
 func (g *GlinkService) processNetworkEvent(ev interface{}) {
-	g.log.Debugf("Input message of type %s", reflect.TypeOf(ev).Name())
 	switch ev := ev.(type) {
+	case NetEvent:
+		info, ok := registry.lookup(ev.Msg)
+		if !ok || info.handler == nil {
+			g.log.Warningf("Service.processNetworkEvent: unexpected message %s", reflect.TypeOf(ev.Msg).Name())
+			return
+		}
+		g.log.Debugf("Input message of type %s from %s", info.name, ev.From)
+		ev, ok = g.verifyNetEvent(ev)
+		if !ok {
+			return
+		}
+		ev, ok = g.dropBlocked(ev)
+		if !ok {
+			return
+		}
+		info.handler(g, ev)
 
+	case PeerConnected:
+		g.log.Infof("Connected to %s(%s)", ev.Name, ev.Uid)
+		g.setConnected(ev.Uid, true)
+
+	case PeerDisconnected:
+		g.log.Infof("Disconnected from %s(%s): %v", ev.Name, ev.Uid, ev.Reason)
+		g.setConnected(ev.Uid, false)
+
+	default:
+		g.log.Warningf("Service.processNetworkEvent: unknown event %s", reflect.TypeOf(ev).Name())
+	}
+}
+
+// verifyNetEvent drops messages that name another sender than the connection
+// they came from, and chat messages with bad signatures, since any peer can
+// relay messages of others. Returns false if nothing is left to handle.
+func (g *GlinkService) verifyNetEvent(ev NetEvent) (NetEvent, bool) {
+	if msg, ok := ev.Msg.(sentBy); ok && msg.sender() != ev.From {
+		g.log.Warningf("Reject %s from %s: it claims to be from %s", reflect.TypeOf(ev.Msg).Name(), ev.From, msg.sender())
+		return ev, false
+	}
+	switch msg := ev.Msg.(type) {
 	case ChatMessage:
-		var index atomic.Uint32
-		index.Store(ev.Index)
-		g.currMsgIndex[ev.Cid] = index
-		err := g.Db.SaveMessage(ev)
+		err := VerifyMessage(msg)
 		if err != nil {
-			g.log.Warningf("Cannot save incoming message: %s", err)
+			g.log.Warningf("Reject message from %s: %s", ev.From, err)
+			return ev, false
 		}
-		g.UxEvents <- ev
 
-	case InviteForJoin:
-		g.log.Infof("Get InviteForJoin msg from %s(%s)", ev.Chat.Name, ev.From)
-		send := JoinChat{From: g.OwnInfo.Uid, To: ev.From, Cid: ev.Chat.Cid}
-		chatName := ev.Chat.Name
-		if !ev.Chat.Group {
-			username, err := g.GetNameByCid(ev.From)
+	case ChatMessagePack:
+		verified := make([]ChatMessage, 0, len(msg.Messages))
+		for _, m := range msg.Messages {
+			err := VerifyMessage(m)
 			if err != nil {
-				g.log.Errorf("Cannot get name by cid: %s", err)
-				return
+				g.log.Warningf("Reject message in pack from %s: %s", ev.From, err)
+				continue
 			}
-			chatName = username
+			verified = append(verified, m)
+		}
+		msg.Messages = verified
+		ev.Msg = msg
+	}
+	return ev, true
+}
+
+// dropBlocked discards everything blocked users send, and messages they wrote
+// that others relay to us.
+func (g *GlinkService) dropBlocked(ev NetEvent) (NetEvent, bool) {
+	if g.Db.IsBlocked(ev.From) {
+		g.log.Debugf("Drop %s from blocked %s", reflect.TypeOf(ev.Msg).Name(), ev.From)
+		if invite, ok := ev.Msg.(InviteForJoin); ok {
+			g.declineBlocked(invite)
 		}
-		err := g.Db.SaveNewChat(ev.Chat.Cid, chatName, ev.Chat.Participants)
+		return ev, false
+	}
+	switch msg := ev.Msg.(type) {
+	case ChatMessage:
+		if g.Db.IsBlocked(msg.Uid) {
+			g.log.Debugf("Drop message of blocked %s", msg.Uid)
+			return ev, false
+		}
+
+	case ChatMessagePack:
+		kept := make([]ChatMessage, 0, len(msg.Messages))
+		for _, m := range msg.Messages {
+			if !g.Db.IsBlocked(m.Uid) {
+				kept = append(kept, m)
+			}
+		}
+		msg.Messages = kept
+		ev.Msg = msg
+	}
+	return ev, true
+}
+
+// declineBlocked answers invite of blocked user, so the inviter does not wait
+// for the answer. The user is not asked.
+func (g *GlinkService) declineBlocked(invite InviteForJoin) {
+	err := g.server.SendTo(invite.From, DeclineInvite{From: g.OwnInfo.Uid, To: invite.From, Cid: invite.Chat.Cid})
+	if err != nil {
+		g.log.Debugf("Cannot decline invite of blocked %s: %s", invite.From, err)
+	}
+}
+
+func (g *GlinkService) onChatMessage(ev ChatMessage) {
+	err := g.saveIncoming(ev)
+	if err != nil {
+		g.log.Warningf("Cannot save incoming message: %s", err)
+		return
+	}
+	var index atomic.Uint32
+	index.Store(ev.Index)
+	g.currMsgIndex[ev.Cid] = index
+	msg, err := g.openMessage(ev)
+	if err != nil {
+		g.log.Warningf("Cannot decrypt message in chat %s: %s", ev.Cid, err)
+		return
+	}
+	g.emit(msg)
+}
+
+func (g *GlinkService) onInviteForJoin(ev InviteForJoin) {
+	g.log.Infof("Get InviteForJoin msg from %s(%s)", ev.Chat.Name, ev.From)
+	peer, ok := g.server.PeerInfo(ev.From)
+	if !ok {
+		g.log.Errorf("Cannot accept invite: no connection to %s", ev.From)
+		return
+	}
+	key, err := OpenChatKey(ev.SealedKey, peer.BoxKey, g.identity.Box)
+	if err != nil {
+		g.log.Errorf("Cannot open key of chat %s: %s", ev.Chat.Cid, err)
+		return
+	}
+	chat := ev.Chat
+	if !chat.Group {
+		username, err := g.GetNameByCid(ev.From)
 		if err != nil {
-			g.log.Errorf("Cannot save new chat: %s", err)
+			g.log.Errorf("Cannot get name by cid: %s", err)
 			return
 		}
-		info := &ChatInfo{Cid: ev.Chat.Cid, Name: chatName, Participants: ev.Chat.Participants, Group: ev.Chat.Group}
-		g.UxEvents <- ChatUpdate{Info: info, NewUids: []Uid{send.From}}
-		SendToAll(g.server, send)
+		chat.Name = username
+	}
+	invite := IncomingInvite{From: ev.From, Chat: chat}
+	err = g.Db.SaveIncomingInvite(invite, key)
+	if err != nil {
+		g.log.Errorf("Cannot save invite: %s", err)
+		return
+	}
+	g.emit(invite)
+}
 
-	case JoinChat:
-		err := g.Db.AddParticipantToChat(ev.Cid, ev.From)
+// AcceptInvite joins the chat of IncomingInvite.
+func (g *GlinkService) AcceptInvite(cid Cid) {
+	g.runCommand(func() {
+		err := g.acceptInvite(cid)
 		if err != nil {
-			g.log.Errorf("Cannot save new chat: %s", err)
+			g.log.Errorf("Cannot accept invite to %s: %s", cid, err)
+		}
+	})
+}
+
+func (g *GlinkService) acceptInvite(cid Cid) error {
+	invite, key, err := g.Db.GetIncomingInvite(cid)
+	if err != nil {
+		return err
+	}
+	err = g.Db.SaveNewChat(cid, invite.Chat.Name, invite.Chat.Participants, key)
+	if err != nil {
+		return fmt.Errorf("Cannot save new chat: %w", err)
+	}
+	err = g.Db.DeleteIncomingInvite(cid)
+	if err != nil {
+		return err
+	}
+	send := JoinChat{From: g.OwnInfo.Uid, To: invite.From, Cid: cid}
+	err = g.server.SendTo(invite.From, send)
+	if err != nil {
+		g.log.Warningf("Cannot send JoinChat to %s: %s", invite.From, err)
+	}
+	g.emit(ChatUpdate{Info: &invite.Chat, NewUids: []Uid{send.From}})
+	return nil
+}
 
+// DeclineInvite forgets IncomingInvite and tells the inviter about it.
+func (g *GlinkService) DeclineInvite(cid Cid) {
+	g.runCommand(func() {
+		err := g.declineInvite(cid)
+		if err != nil {
+			g.log.Errorf("Cannot decline invite to %s: %s", cid, err)
 		}
-		info, err := g.Db.GetChatInfo(ev.Cid)
+	})
+}
+
+func (g *GlinkService) declineInvite(cid Cid) error {
+	invite, _, err := g.Db.GetIncomingInvite(cid)
+	if err != nil {
+		return err
+	}
+	err = g.Db.DeleteIncomingInvite(cid)
+	if err != nil {
+		return err
+	}
+	return g.server.SendTo(invite.From, DeclineInvite{From: g.OwnInfo.Uid, To: invite.From, Cid: cid})
+}
+
+func (g *GlinkService) onDeclineInvite(ev DeclineInvite) {
+	invited, err := g.Db.TakePendingInvite(ev.Cid, ev.From, time.Now())
+	if err != nil {
+		g.log.Errorf("Cannot check pending invites: %s", err)
+		return
+	}
+	if !invited {
+		g.log.Warningf("Ignore DeclineInvite from %s to chat %s: no pending invite", ev.From, ev.Cid)
+		return
+	}
+	name, _ := g.GetNameByCid(ev.From)
+	g.log.Infof("%s(%s) declined invite to chat %s", name, ev.From, ev.Cid)
+	info, err := g.Db.GetChatInfo(ev.Cid)
+	if err != nil || info == nil {
+		g.log.Errorf("Cannot get chat info for cid %s", ev.Cid)
+		return
+	}
+	declined := InviteDeclined{From: ev.From, Chat: *info}
+	// Chat made for the invite has only us in it, it is of no use now.
+	if len(info.Participants) == 1 && info.Participants[0] == g.OwnInfo.Uid {
+		err = g.Db.DeleteChat(ev.Cid)
 		if err != nil {
-			g.log.Errorf("Cannot get chat info for cid %s", ev.Cid)
+			g.log.Errorf("Cannot delete chat %s: %s", ev.Cid, err)
+		}
+		declined.Removed = err == nil
+	}
+	g.emit(declined)
+}
+
+func (g *GlinkService) onJoinChat(ev JoinChat) {
+	invited, err := g.Db.TakePendingInvite(ev.Cid, ev.From, time.Now())
+	if err != nil {
+		g.log.Errorf("Cannot check pending invites: %s", err)
+		return
+	}
+	if !invited {
+		g.log.Warningf("Ignore JoinChat from %s to chat %s: no pending invite", ev.From, ev.Cid)
+		return
+	}
+	err = g.Db.AddParticipantToChat(ev.Cid, ev.From)
+	if err != nil {
+		g.log.Errorf("Cannot save new chat: %s", err)
+
+	}
+	info, err := g.Db.GetChatInfo(ev.Cid)
+	if err != nil {
+		g.log.Errorf("Cannot get chat info for cid %s", ev.Cid)
+		return
+	}
+	g.emit(ChatUpdate{Info: info, NewUids: []Uid{ev.From}})
+}
+
+func (g *GlinkService) onWatchedCids(ev WatchedCids) (HaveCidInfo, error) {
+	vc, err := g.GetVectorClockOfKnownCids(ev.Cids)
+	if err != nil {
+		g.log.Errorf("Cannot get vector clock of cids [%v], error: %s", ev.Cids, err)
+	}
+	if g.log.IsTraceEnabled() {
+		pp, _ := json.MarshalIndent(vc, "", "  ")
+		g.log.Tracef("Return vector clock to %s\n%s", ev.From, pp)
+	}
+	return HaveCidInfo{From: g.OwnInfo.Uid, To: ev.From, ChatsVectorClock: vc}, nil
+}
+
+func (g *GlinkService) onMessagesRequest(ev MessagesRequest) (ChatMessagePack, error) {
+	msgs, err := g.Db.GetMessagesByVectorClock(ev.VectorClockFrom)
+	if err != nil {
+		return ChatMessagePack{}, fmt.Errorf("Cannot get messages by vector: %w", err)
+	}
+	res := make([]ChatMessage, 0, len(msgs))
+	for _, msg := range msgs {
+		if msg.Sealed == nil {
+			// Saved before encryption was introduced, never send it as is.
+			key, err := g.chatKey(msg.Cid)
+			if err != nil {
+				continue
+			}
+			msg.Sealed, err = SealText(msg.Text, key)
+			if err != nil {
+				return ChatMessagePack{}, fmt.Errorf("Cannot encrypt message: %w", err)
+			}
+		}
+		msg.Text = ""
+		if msg.Signature == nil {
+			// Saved before messages were signed. Peer rejects unsigned
+			// messages, so only own ones can still be sent.
+			if msg.Uid != g.OwnInfo.Uid {
+				continue
+			}
+			msg = g.identity.SignMessage(msg)
+		}
+		res = append(res, msg)
+	}
+	return ChatMessagePack{From: g.OwnInfo.Uid, To: ev.From, Messages: res}, nil
+}
+
+func (g *GlinkService) onChatMessagePack(ev ChatMessagePack) {
+	opened := make([]ChatMessage, 0, len(ev.Messages))
+	for _, msg := range ev.Messages {
+		err := g.saveIncoming(msg)
+		if err != nil {
+			g.log.Errorf("Cannot save msg to db: %s", err)
 			return
 		}
-		g.UxEvents <- ChatUpdate{Info: info, NewUids: []Uid{ev.From}}
+		msg, err = g.openMessage(msg)
+		if err != nil {
+			g.log.Warningf("Cannot decrypt message in chat %s: %s", msg.Cid, err)
+			continue
+		}
+		opened = append(opened, msg)
+	}
+	ev.Messages = opened
+	g.emit(ev)
+}
 
-	case WatchedCids:
-		vc, err := g.GetVectorClockOfKnownCids(ev.Cids)
+func (g *GlinkService) processCommand(cmd string) {
+	g.log.Debugf("process user command: %s", cmd)
+	name, arg, _ := strings.Cut(cmd, " ")
+	switch name {
+	case "conn":
+		g.inviteCandidate(arg)
+	case "connect":
+		g.dialAddress(arg, sourceManual)
+	case "verify":
+		g.showSafetyNumber(arg)
+	case "unverify":
+		uid, err := g.Db.FindUid(arg)
 		if err != nil {
-			g.log.Errorf("Cannot get vector clock of cids [%v], error: %s", ev.Cids, err)
+			g.log.Errorf("Cannot find contact %s: %s", arg, err)
+			return
 		}
-		if g.log.IsTraceEnabled() {
-			pp, _ := json.MarshalIndent(vc, "", "  ")
-			g.log.Tracef("Return vector clock to %s\n%s", ev.From, pp)
+		err = g.setVerified(uid, false)
+		if err != nil {
+			g.log.Errorf("Cannot unverify %s: %s", arg, err)
 		}
-		err = SendTo(g.server, ev.From, HaveCidInfo{From: g.OwnInfo.Uid, To: ev.From, ChatsVectorClock: vc})
+	case "accept", "decline":
+		invite, err := g.findIncomingInvite(arg)
 		if err != nil {
-			g.log.Errorf("Cannot send vector clock to %s, error: %s", ev.From, err)
+			g.log.Errorf("Cannot %s invite: %s", name, err)
+			return
+		}
+		if name == "accept" {
+			err = g.acceptInvite(invite.Chat.Cid)
+		} else {
+			err = g.declineInvite(invite.Chat.Cid)
 		}
-
-	case HaveCidInfo:
-		req, err := g.GenerateMessagesRequest(ev.ChatsVectorClock)
 		if err != nil {
-			g.log.Errorf("Cannot enerate message request: %s", err)
+			g.log.Errorf("Cannot %s invite to %s: %s", name, invite.Chat.Name, err)
 		}
-		if len(req) == 0 {
+	case "block", "unblock":
+		uid, err := g.Db.FindUid(arg)
+		if err != nil {
+			g.log.Errorf("Cannot find contact %s: %s", arg, err)
 			return
 		}
-		err = SendTo(g.server, ev.From, MessagesRequest{From: g.OwnInfo.Uid, To: ev.From, VectorClockFrom: req})
+		err = g.Db.SetBlocked(uid, name == "block")
 		if err != nil {
-			g.log.Errorf("Cannot send message request: %s", err)
+			g.log.Errorf("Cannot %s %s: %s", name, arg, err)
+			return
+		}
+		if name == "block" {
+			g.server.Disconnect(uid, ErrBlocked)
 		}
+		g.log.Infof("Contact %s(%s) is %sed", arg, uid, name)
+	default:
+		g.log.Errorf("Unknown command %s", name)
+	}
+}
+
+// findIncomingInvite looks up invite by chat name. Empty name is fine if
+// there is only one invite.
+func (g *GlinkService) findIncomingInvite(chatName string) (IncomingInvite, error) {
+	invites, err := g.Db.GetIncomingInvites()
+	if err != nil {
+		return IncomingInvite{}, err
+	}
+	var found []IncomingInvite
+	for _, invite := range invites {
+		if chatName == "" || invite.Chat.Name == chatName {
+			found = append(found, invite)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return IncomingInvite{}, fmt.Errorf("No invite to chat %q", chatName)
+	case 1:
+		return found[0], nil
+	default:
+		return IncomingInvite{}, fmt.Errorf("%d invites match %q, specify chat name", len(found), chatName)
+	}
+}
+
+func (g *GlinkService) inviteCandidate(conn_name string) {
+	node, ok := g.connCandidate[conn_name]
+	if !ok {
+		g.log.Errorf("Cannot find connection named %s", conn_name)
+		return
+	}
+	g.Db.SaveNewUid(node.ClientId, node.ClientName, node.Endpoint)
+	if _, connected := g.server.PeerInfo(node.ClientId); !connected {
+		g.initHandshake(node.ClientId, node.Endpoint)
+	}
+
+	peer, ok := g.server.PeerInfo(node.ClientId)
+	if !ok {
+		g.log.Errorf("Cannot invite %s: no connection", conn_name)
+		return
+	}
+	key, err := NewChatKey()
+	if err != nil {
+		g.log.Errorf("Cannot generate chat key: %s", err)
+		return
+	}
+	sealedKey, err := SealChatKey(key, peer.BoxKey, g.identity.Box)
+	if err != nil {
+		g.log.Errorf("Cannot encrypt chat key for %s: %s", conn_name, err)
+		return
+	}
+
+	cid := Cid(uuid.New().String())
+	participants := []Uid{g.OwnInfo.Uid}
+	chatInfo := ChatInfo{Cid: cid, Participants: participants, Group: false}
+	msg := InviteForJoin{From: g.OwnInfo.Uid, To: node.ClientId, Chat: chatInfo, SealedKey: sealedKey}
+	err = g.Db.SaveNewChat(cid, node.ClientName, participants, key)
+	if err != nil {
+		g.log.Errorf("Cannot save new chat: %s", err)
+		return
+	}
+	err = g.Db.AddPendingInvite(cid, node.ClientId, time.Now().Add(inviteExpiry))
+	if err != nil {
+		g.log.Errorf("Cannot save pending invite: %s", err)
+		return
+	}
+	g.log.Debugf("Sending AskForJoin")
+	err = g.server.SendTo(node.ClientId, msg)
+	if err != nil {
+		g.log.Errorf("Cannot send AskForJoin message: %s", err)
+		return
+	}
+	chatInfo.Name = node.ClientName
+	g.emit(ChatUpdate{Info: &chatInfo, NewUids: []Uid{msg.From}})
+}
 
-	case MessagesRequest:
-		msgs, err := g.Db.GetMessagesByVectorClock(ev.VectorClockFrom)
+// showSafetyNumber sends SafetyNumberInfo of the contact to UI. Users compare it
+// in person and then mark the contact verified. Contact is found by name or
+// uid prefix, see Db.FindUid.
+func (g *GlinkService) showSafetyNumber(query string) {
+	uid, err := g.Db.FindUid(query)
+	if err != nil {
+		g.log.Errorf("Cannot find contact %s: %s", query, err)
+		return
+	}
+	name, err := g.Db.GetNameByUid(uid)
+	if err != nil {
+		g.log.Errorf("Cannot get name of %s: %s", uid, err)
+		return
+	}
+	number, err := g.SafetyNumber(uid)
+	if err != nil {
+		g.log.Errorf("Cannot make safety number for %s: %s", name, err)
+		return
+	}
+	g.log.Infof("Safety number with %s(%s): %s", name, uid, number)
+	g.emit(SafetyNumberInfo{Uid: uid, Name: name, Number: number})
+}
+
+// SafetyNumber is the same on both sides, if both have the right keys.
+func (g *GlinkService) SafetyNumber(uid Uid) (string, error) {
+	key, err := g.Db.GetIdentityKey(uid)
+	if err != nil {
+		return "", err
+	}
+	if key == nil {
+		return "", fmt.Errorf("No identity key of %s yet", uid)
+	}
+	return SafetyNumber(g.identity.SignKey(), key), nil
+}
+
+// SetVerified marks the contact verified after user compared safety numbers.
+func (g *GlinkService) SetVerified(uid Uid, verified bool) {
+	g.runCommand(func() {
+		err := g.setVerified(uid, verified)
 		if err != nil {
-			g.log.Errorf("Cannot get messages by vector: %s", err)
-			return
+			g.log.Errorf("Cannot mark %s verified: %s", uid, err)
 		}
-		SendTo(g.server, ev.From, ChatMessagePack{From: g.OwnInfo.Uid, To: ev.From, Messages: msgs})
+	})
+}
 
-	case ChatMessagePack:
-		for _, msg := range ev.Messages {
-			err := g.Db.SaveMessage(msg)
-			if err != nil {
-				g.log.Errorf("Cannot save msg to db: %s", err)
-				return
+func (g *GlinkService) setVerified(uid Uid, verified bool) error {
+	err := g.Db.SetVerified(uid, verified)
+	if err != nil {
+		return err
+	}
+	g.log.Infof("Contact %s is verified: %v", uid, verified)
+	g.emit(ContactVerified{Uid: uid, Verified: verified})
+	return nil
+}
+
+func (g *GlinkService) processDiscoveryEvent(ev interface{}) {
+	switch ev := ev.(type) {
+	case DiscoveryInfo:
+		g.onNodeSeen(ev)
+
+	case NodeChanged:
+		if ev.Info.ClientId == g.OwnInfo.Uid {
+			return
+		}
+		if ev.Info.Endpoint == ev.Old.Endpoint && ev.Info.ClientName == ev.Old.ClientName {
+			// Only the set of backends that see the node has changed. Nodes
+			// ignored by onNodeSeen have no presence.
+			if g.presence[ev.Info.ClientId] != nil {
+				g.setDiscoverySources(ev.Info.ClientId, ev.Info.Backends())
 			}
+			return
 		}
-		g.UxEvents <- ev
+		g.log.Infof("Node %s(%s) moved from %s to %s", ev.Info.ClientName, ev.Info.ClientId, ev.Old.Endpoint, ev.Info.Endpoint)
+		g.forgetCandidate(ev.Old.ClientId, ev.Old.ClientName)
+		g.onNodeSeen(ev.Info)
+
+	case PeerAddress:
+		g.onPeerAddress(ev.Endpoint)
+
+	case NodeLost:
+		if ev.Uid == g.OwnInfo.Uid {
+			return
+		}
+		g.log.Infof("Node %s(%s) is gone", ev.Name, ev.Uid)
+		g.forgetCandidate(ev.Uid, ev.Name)
+		g.setDiscoverySources(ev.Uid, nil)
 
 	default:
-		g.log.Warningf("Service.processNetworkEvent: unknown event %s", reflect.TypeOf(ev).Name())
+		g.log.Warningf("Service.processDiscoveryEvent: unknown event %s", reflect.TypeOf(ev).Name())
 	}
 }
 
-func (g *GlinkService) processCommand(cmd string) {
-	g.log.Debugf("process user command: %s", cmd)
-	if strings.HasPrefix(cmd, "conn ") {
-		conn_name := cmd[5:]
-		node, ok := g.connCandidate[conn_name]
-		if !ok {
-			g.log.Errorf("Cannot find connection named %s", conn_name)
+// onPeerAddress connects to static peer unless it is connected already.
+func (g *GlinkService) onPeerAddress(endpoint string) {
+	uid, ok := g.staticPeers[endpoint]
+	if ok {
+		if _, connected := g.server.PeerInfo(uid); connected {
+			g.addSource(uid, BackendStatic)
 			return
 		}
-		g.Db.SaveNewUid(node.ClientId, node.ClientName, node.Endpoint)
-		g.initHandshake(node.ClientId, node.Endpoint)
+		delete(g.staticPeers, endpoint)
+	}
+	g.dialAddress(endpoint, BackendStatic)
+}
 
-		cid := Cid(uuid.New().String())
-		participants := []Uid{g.OwnInfo.Uid}
-		chatInfo := ChatInfo{Cid: cid, Participants: participants, Group: false}
-		msg := InviteForJoin{From: g.OwnInfo.Uid, To: node.ClientId, Chat: chatInfo}
-		err := g.Db.SaveNewChat(cid, node.ClientName, participants)
-		if err != nil {
-			g.log.Errorf("Cannot save new chat: %s", err)
-			return
+// sourceManual marks peers connected with !connect.
+const sourceManual = "manual"
+
+// dialResult is the outcome of dialAddress.
+type dialResult struct {
+	endpoint string
+	source   string
+	info     ConnectInfo
+	err      error
+}
+
+// dialAddress connects to endpoint in background, since unreachable endpoint
+// takes up to handshakeTimeout. The result comes to onDialed. Source tells
+// how the endpoint was found.
+func (g *GlinkService) dialAddress(endpoint string, source string) {
+	if g.dialing[endpoint] {
+		g.log.Debugf("Already connecting to %s", endpoint)
+		return
+	}
+	g.dialing[endpoint] = true
+	g.spawn(func() {
+		info, err := g.server.ConnectTo(endpoint)
+		select {
+		case g.dials <- dialResult{endpoint: endpoint, source: source, info: info, err: err}:
+		case <-g.ctx.Done():
+		}
+	})
+}
+
+func (g *GlinkService) onDialed(res dialResult) {
+	delete(g.dialing, res.endpoint)
+	err := res.err
+	if err == nil {
+		err = g.addAddressContact(res.endpoint, res.source, res.info)
+	}
+	if err != nil && res.source == BackendStatic {
+		g.log.Debugf("Cannot connect to static peer %s: %s", res.endpoint, err)
+		return
+	}
+	if err != nil {
+		g.log.Errorf("Cannot connect to %s: %s", res.endpoint, err)
+		return
+	}
+	if res.source == BackendStatic {
+		g.staticPeers[res.endpoint] = res.info.MyUid
+		return
+	}
+	g.log.Infof("Connected to %s(%s), invite with !conn %s", res.info.MyName, res.info.MyUid, res.info.MyName)
+}
+
+// addAddressContact adds whoever answered on endpoint as a contact, so that
+// it can be invited with !conn.
+func (g *GlinkService) addAddressContact(endpoint string, source string, info ConnectInfo) error {
+	if !g.Db.IsKnownUid(info.MyUid) {
+		err := g.Db.SaveNewUid(info.MyUid, info.MyName, endpoint)
+		if err == nil {
+			err = g.Db.PinIdentityKey(info.MyUid, info.IdentityKey)
 		}
-		g.log.Debugf("Sending AskForJoin")
-		err = SendTo(g.server, node.ClientId, msg)
 		if err != nil {
-			g.log.Errorf("Cannot send AskForJoin message: %s", err)
-			return
+			return fmt.Errorf("Cannot save contact: %w", err)
 		}
-		chatInfo.Name = node.ClientName
-		g.UxEvents <- ChatUpdate{Info: &chatInfo, NewUids: []Uid{msg.From}}
+	}
+	g.connCandidate[info.MyName] = DiscoveryInfo{
+		ClientId:   info.MyUid,
+		ClientName: info.MyName,
+		Endpoint:   endpoint,
+		PublicKey:  info.IdentityKey,
+		Source:     source,
+	}
+	g.addSource(info.MyUid, source)
+	err := g.startSync(info.MyUid)
+	if err != nil {
+		g.log.Warningf("Cannot sync with %s: %s", info.MyName, err)
+	}
+	return nil
+}
+
+// forgetCandidate removes node from candidates for !conn.
+func (g *GlinkService) forgetCandidate(uid Uid, name string) {
+	if node, ok := g.connCandidate[name]; ok && node.ClientId == uid {
+		delete(g.connCandidate, name)
 	}
 }
 
-func (g *GlinkService) processDiscoveryEvent(new_node DiscoveryInfo) {
-	if new_node.ClientId == g.OwnInfo.Uid {
+func (g *GlinkService) onNodeSeen(new_node DiscoveryInfo) {
+	if new_node.ClientId == g.OwnInfo.Uid || g.Db.IsBlocked(new_node.ClientId) {
+		return
+	}
+	err := VerifyAnnounce(new_node.Announce())
+	if err != nil {
+		g.log.Warningf("Ignore node %s(%s): %s", new_node.ClientName, new_node.ClientId, err)
+		return
+	}
+	err = g.checkContactName(new_node.ClientId, new_node.ClientName, new_node.PublicKey)
+	if err != nil {
 		return
 	}
 	if g.Db.IsKnownUid(new_node.ClientId) {
+		g.setDiscoverySources(new_node.ClientId, new_node.Backends())
+		// Announces repeat, and the node may have dialed us already.
+		if _, connected := g.server.PeerInfo(new_node.ClientId); connected {
+			return
+		}
 		g.log.Infof("connect to known id: %s", new_node.ClientName)
 		g.initHandshake(new_node.ClientId, new_node.Endpoint)
 	} else {
-		g.log.Infof("New node: %s(%s): %s", new_node.ClientName, new_node.ClientId, new_node.Endpoint)
+		g.log.Infof("New node: %s(%s): %s via %s", new_node.ClientName, new_node.ClientId, new_node.Endpoint, new_node.Source)
 		// TODO: save endpoints?
 		// TODO: now logic of SaveNewUid is spread in several place. Need to figure out way to fix it
 		g.Db.SaveNewUid(new_node.ClientId, new_node.ClientName, "")
+		g.Db.PinIdentityKey(new_node.ClientId, new_node.PublicKey)
 		g.connCandidate[new_node.ClientName] = new_node
+		g.setDiscoverySources(new_node.ClientId, new_node.Backends())
+	}
+}
+
+// nodePresence tells how other node is reachable. Sources are discovery
+// backends that see the node, and static or manual while the connection made
+// by address is alive. Reported is the last Presence sent to UX.
+type nodePresence struct {
+	sources   map[string]bool
+	connected bool
+	reported  Presence
+}
+
+// addSource records that source sees the node. Node found both by discovery
+// and by address is one node with two sources.
+func (g *GlinkService) addSource(uid Uid, source string) {
+	node := g.nodePresence(uid)
+	node.sources[source] = true
+	g.reportPresence(uid, node)
+}
+
+// setConnected records whether there is connection with the node. Static and
+// manual sources are the connection itself, so they are gone with it.
+func (g *GlinkService) setConnected(uid Uid, connected bool) {
+	node := g.nodePresence(uid)
+	node.connected = connected
+	if !connected {
+		delete(node.sources, BackendStatic)
+		delete(node.sources, sourceManual)
+	}
+	g.reportPresence(uid, node)
+}
+
+// setDiscoverySources replaces discovery backends that see the node, static
+// and manual sources stay. NodeLost means that no backend sees the node, see
+// MultiDiscovery.
+func (g *GlinkService) setDiscoverySources(uid Uid, backends []string) {
+	node := g.nodePresence(uid)
+	for source := range node.sources {
+		if source != BackendStatic && source != sourceManual {
+			delete(node.sources, source)
+		}
+	}
+	for _, source := range backends {
+		node.sources[source] = true
 	}
+	g.reportPresence(uid, node)
+}
+
+func (g *GlinkService) nodePresence(uid Uid) *nodePresence {
+	node, ok := g.presence[uid]
+	if !ok {
+		node = &nodePresence{sources: make(map[string]bool), reported: Presence{Uid: uid}}
+		g.presence[uid] = node
+	}
+	return node
+}
+
+// reportPresence sends Presence to UX if it has changed. Node is offline only
+// when no source sees it and there is no connection.
+func (g *GlinkService) reportPresence(uid Uid, node *nodePresence) {
+	ev := Presence{Uid: uid, Online: node.connected || len(node.sources) != 0}
+	for source := range node.sources {
+		ev.Sources = append(ev.Sources, source)
+	}
+	sort.Strings(ev.Sources)
+	if !ev.Online {
+		delete(g.presence, uid)
+	}
+	if reflect.DeepEqual(ev, node.reported) {
+		return
+	}
+	node.reported = ev
+	g.emit(ev)
 }
 
 func (g *GlinkService) initHandshake(uid Uid, endpoint string) error {
@@ -318,14 +1222,66 @@ func (g *GlinkService) initHandshake(uid Uid, endpoint string) error {
 	if err != nil {
 		return err
 	}
+	return g.startSync(uid)
+}
+
+// startSync pulls history from just connected peer in background.
+func (g *GlinkService) startSync(uid Uid) error {
+	if !g.server.SupportsFeature(uid, FeatureSync) {
+		g.log.Infof("Peer %s does not support history sync", uid)
+		return nil
+	}
 	watchedCids, err := g.GetWatchedCids()
 	if err != nil {
 		return err
 	}
-	err = SendTo(g.server, uid, WatchedCids{From: g.OwnInfo.Uid, To: uid, Cids: watchedCids})
+	g.spawn(func() { g.syncWith(uid, watchedCids) })
+	return nil
+}
+
+// syncWith pulls messages of watched chats that peer has and we don't.
+// Runs outside of service loop, received messages are passed back to it.
+func (g *GlinkService) syncWith(uid Uid, cids []Cid) {
+	for attempt := 1; attempt <= syncAttempts; attempt++ {
+		err := g.syncRound(uid, cids)
+		if err == nil {
+			return
+		}
+		g.log.Warningf("Sync with %s failed (attempt %d of %d): %s", uid, attempt, syncAttempts, err)
+		if errors.Is(err, ErrConnectionClosed) || g.ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-time.After(syncRetryDelay):
+		case <-g.ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *GlinkService) syncRound(uid Uid, cids []Cid) error {
+	ctx, cancel := context.WithTimeout(g.ctx, syncTimeout)
+	defer cancel()
+
+	info, err := Request[HaveCidInfo](ctx, g.server, uid, WatchedCids{From: g.OwnInfo.Uid, To: uid, Cids: cids})
+	if err != nil {
+		return err
+	}
+	req, err := g.GenerateMessagesRequest(info.ChatsVectorClock)
+	if err != nil {
+		return fmt.Errorf("Cannot generate message request: %w", err)
+	}
+	if len(req) == 0 {
+		return nil
+	}
+	pack, err := Request[ChatMessagePack](ctx, g.server, uid, MessagesRequest{From: g.OwnInfo.Uid, To: uid, VectorClockFrom: req})
 	if err != nil {
 		return err
 	}
+	select {
+	case g.serverEvents <- NetEvent{From: uid, Msg: pack}:
+	case <-g.ctx.Done():
+	}
 	return nil
 }
 
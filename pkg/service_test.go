@@ -1,8 +1,12 @@
 package glink
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/juju/loggo"
 	"github.com/stretchr/testify/require"
@@ -11,13 +15,20 @@ import (
 type FakeServer struct {
 	evChan      chan interface{}
 	connections map[Uid]string
-	msgs        map[Uid][]MsgBytes
+	msgs        map[Uid][]any
+	boxKeys     map[Uid][]byte
+	// listeners are peers ConnectTo finds on endpoints.
+	listeners map[string]ConnectInfo
+	// dialGate, if set, holds ConnectTo until closed.
+	dialGate chan struct{}
 }
 
 func NewFakeServer() *FakeServer {
 	return &FakeServer{
 		connections: make(map[Uid]string),
-		msgs:        make(map[Uid][]MsgBytes),
+		msgs:        make(map[Uid][]any),
+		boxKeys:     make(map[Uid][]byte),
+		listeners:   make(map[string]ConnectInfo),
 	}
 }
 
@@ -29,7 +40,7 @@ func (f *FakeServer) ListenerAddress() string {
 	return "0.0.0.0:1234"
 }
 
-func (f *FakeServer) SendTo(uid Uid, msg MsgBytes) error {
+func (f *FakeServer) SendTo(uid Uid, msg any) error {
 	_, ok := f.connections[uid]
 	if !ok {
 		return fmt.Errorf("No connection %s", uid)
@@ -38,9 +49,11 @@ func (f *FakeServer) SendTo(uid Uid, msg MsgBytes) error {
 	return nil
 }
 
-func (f *FakeServer) SendToAll(msg MsgBytes) error {
+func (f *FakeServer) SendToAll(msg any, skip func(uid Uid) bool) error {
 	for u := range f.connections {
-		f.msgs[u] = append(f.msgs[u], msg)
+		if !skip(u) {
+			f.msgs[u] = append(f.msgs[u], msg)
+		}
 	}
 	return nil
 }
@@ -50,9 +63,52 @@ func (f *FakeServer) MakeNewConnectionTo(uid Uid, endpoint string) error {
 	return nil
 }
 
+func (f *FakeServer) ConnectTo(endpoint string) (ConnectInfo, error) {
+	if f.dialGate != nil {
+		<-f.dialGate
+	}
+	info, ok := f.listeners[endpoint]
+	if !ok {
+		return info, fmt.Errorf("Nobody listens on %s", endpoint)
+	}
+	f.connections[info.MyUid] = endpoint
+	return info, nil
+}
+
+func (f *FakeServer) Request(ctx context.Context, uid Uid, msg any) (any, error) {
+	err := f.SendTo(uid, msg)
+	if err != nil {
+		return nil, err
+	}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (f *FakeServer) Reply(uid Uid, requestId uint32, msg any) error {
+	return f.SendTo(uid, msg)
+}
+
+func (f *FakeServer) SupportsFeature(uid Uid, feature string) bool {
+	_, ok := f.connections[uid]
+	return ok
+}
+
+func (f *FakeServer) PeerInfo(uid Uid) (ConnectInfo, bool) {
+	_, ok := f.connections[uid]
+	return ConnectInfo{MyUid: uid, BoxKey: f.boxKeys[uid]}, ok
+}
+
+func (f *FakeServer) SetAdmission(admit func(info ConnectInfo) error) {}
+
+func (f *FakeServer) Disconnect(uid Uid, reason error) {
+	delete(f.connections, uid)
+}
+
+func (f *FakeServer) Close() {}
+
 type FakeDiscovery struct{}
 
-func (d *FakeDiscovery) Run(eventChan chan DiscoveryInfo) error {
+func (d *FakeDiscovery) Run(eventChan chan interface{}) error {
 	return nil
 }
 
@@ -66,12 +122,21 @@ func TestSendMessageRecieveInServer(t *testing.T) {
 	db, err := NewDb("")
 	require.Nil(t, err)
 
-	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "name", Uid: "uid"})
+	identity := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "name", Uid: identity.Uid()}, identity)
 	require.Nil(t, err)
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{"uid"}, key))
 	sendMsg := ChatMessage{Uid: "uid", Cid: "cid", Index: 1, Text: "sample text"}
-	gs.UserMessage(sendMsg)
-	expect, _ := EncodeMsg(sendMsg)
-	require.Equal(t, []MsgBytes{expect}, server.msgs["uid"])
+	require.Nil(t, gs.UserMessage(sendMsg))
+	require.Len(t, server.msgs["uid"], 1)
+	wireMsg := server.msgs["uid"][0].(ChatMessage)
+	require.Equal(t, "", wireMsg.Text)
+	require.Nil(t, VerifyMessage(wireMsg))
+	text, err := OpenText(wireMsg.Sealed, key)
+	require.Nil(t, err)
+	require.Equal(t, sendMsg.Text, text)
 }
 
 func TestSendMessageSavedInDb(t *testing.T) {
@@ -82,15 +147,643 @@ func TestSendMessageSavedInDb(t *testing.T) {
 	db, err := NewDb("")
 	require.Nil(t, err)
 
-	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "name", Uid: "uid"})
+	identity := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "name", Uid: identity.Uid()}, identity)
 	require.Nil(t, err)
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{"uid"}, key))
 	sendMsg := ChatMessage{Uid: "uid", Cid: "cid", Index: 1, Text: "sample text"}
-	gs.UserMessage(sendMsg)
+	require.Nil(t, gs.UserMessage(sendMsg))
+
+	stored, err := db.GetMessages("cid", 0, 1000)
+	require.Nil(t, err)
+	require.Len(t, stored, 1)
+	require.Equal(t, "", stored[0].Text)
+
+	msgs, err := gs.GetMessages("cid")
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, sendMsg.Text, msgs[0].Text)
+}
+
+func TestSendMessageWithoutChatKey(t *testing.T) {
+	server := NewFakeServer()
+	server.MakeNewConnectionTo("uid", "")
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "name", Uid: "uid"}, newTestIdentity(t))
+	require.Nil(t, err)
+	err = gs.UserMessage(ChatMessage{Cid: "cid", Text: "sample text"})
+	require.ErrorIs(t, err, ErrNoChatKey)
+	require.Empty(t, server.msgs["uid"])
+}
+
+func TestInviteForJoinOpensChatKey(t *testing.T) {
+	alice := newTestIdentity(t)
+	server := NewFakeServer()
+	server.MakeNewConnectionTo("alice", "")
+	server.boxKeys["alice"] = alice.Box.Public[:]
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: "bob"}, bob)
+	require.Nil(t, err)
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	sealedKey, err := SealChatKey(key, bob.Box.Public[:], alice.Box)
+	require.Nil(t, err)
+
+	chat := ChatInfo{Cid: "cid", Participants: []Uid{"alice"}, Name: "group", Group: true}
+	gs.onInviteForJoin(InviteForJoin{From: "alice", To: "bob", Chat: chat, SealedKey: sealedKey})
+	require.Equal(t, IncomingInvite{From: "alice", Chat: chat}, <-gs.UxEvents)
+	stored, err := db.GetChatKey("cid")
+	require.Nil(t, err)
+	require.Nil(t, stored)
+	require.Empty(t, server.msgs["alice"])
+
+	gs.processCommand("accept group")
+	stored, err = db.GetChatKey("cid")
+	require.Nil(t, err)
+	require.Equal(t, key, stored)
+	require.Equal(t, []any{JoinChat{From: "bob", To: "alice", Cid: "cid"}}, server.msgs["alice"])
+	invites, err := db.GetIncomingInvites()
+	require.Nil(t, err)
+	require.Empty(t, invites)
+
+	sealed, err := SealText("hi", key)
+	require.Nil(t, err)
+	gs.onChatMessage(ChatMessage{Uid: "alice", Cid: "cid", Index: 1, Text: "leaked", Sealed: sealed})
+	msgs, err := db.GetMessages("cid", 0, 1000)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "", msgs[0].Text)
+}
+
+func TestForgedMessagesRejected(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	mallory := newTestIdentity(t)
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{alice.Uid(), bob.Uid()}, key))
+	newMsg := func(signer *Identity, index uint32, text string) ChatMessage {
+		sealed, err := SealText(text, key)
+		require.Nil(t, err)
+		return signer.SignMessage(ChatMessage{Uid: alice.Uid(), Cid: "cid", Index: index, Sealed: sealed})
+	}
+
+	gs.processNetworkEvent(NetEvent{From: mallory.Uid(), Msg: newMsg(mallory, 1, "forged")})
 	msgs, err := db.GetMessages("cid", 0, 1000)
 	require.Nil(t, err)
-	require.Equal(t, []ChatMessage{sendMsg}, msgs)
+	require.Empty(t, msgs)
+
+	tampered := newMsg(alice, 2, "original")
+	tampered.Index = 5
+	pack := ChatMessagePack{From: mallory.Uid(), To: bob.Uid(), Messages: []ChatMessage{newMsg(alice, 1, "hello"), tampered}}
+	gs.processNetworkEvent(NetEvent{From: mallory.Uid(), Msg: pack})
+	msgs, err = gs.GetMessages("cid")
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, "hello", msgs[0].Text)
 }
 
+func TestContactNameWithOtherKeyRefused(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	bob := newTestIdentity(t)
+	own := UserLightInfo{Name: "bob", Uid: bob.Uid()}
+	server, err := NewServer(own, bob, DefaultServerConfig(), &logger)
+	require.Nil(t, err)
+	db, err := NewDb("")
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, own, bob)
+	require.Nil(t, err)
+	t.Cleanup(func() { gs.Stop() })
+
+	alice := newTestIdentity(t)
+	announce := alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+	gs.processDiscoveryEvent(discoveryInfo(announce))
+	require.IsType(t, Presence{}, <-gs.UxEvents)
+
+	mallory, _ := newTestServer(t, "alice")
+	impostor := mallory.identity.SignAnnounce(NodeAnnounce{Uid: mallory.own_info.Uid, Name: "alice", Endpoint: mallory.ListenerAddress()})
+	gs.processDiscoveryEvent(discoveryInfo(impostor))
+	warning := (<-gs.UxEvents).(KeyChangeWarning)
+	require.Equal(t, mallory.own_info.Uid, warning.Uid)
+	require.Equal(t, alice.Uid(), warning.KnownUid)
+	require.Equal(t, []byte(alice.SignKey()), warning.PinnedKey)
+	require.Equal(t, alice.Uid(), gs.connCandidate["alice"].ClientId)
+	require.False(t, db.IsKnownUid(mallory.own_info.Uid))
+
+	// Handshake is refused as well, without another warning.
+	err = mallory.MakeNewConnectionTo(bob.Uid(), server.ListenerAddress())
+	require.ErrorIs(t, err, ErrConnectionRefused)
+	require.Empty(t, gs.UxEvents)
+
+	// Rejected uid is still refused, and the user is warned again.
+	gs.RejectKeyChange(warning)
+	(<-gs.commands)()
+	err = mallory.MakeNewConnectionTo(bob.Uid(), server.ListenerAddress())
+	require.ErrorIs(t, err, ErrConnectionRefused)
+	require.Equal(t, warning, <-gs.UxEvents)
+	require.False(t, db.IsKnownUid(mallory.own_info.Uid))
+
+	gs.AcceptKeyChange(warning)
+	(<-gs.commands)()
+	require.Nil(t, mallory.MakeNewConnectionTo(bob.Uid(), server.ListenerAddress()))
+	uids, err := db.GetUidsByName("alice")
+	require.Nil(t, err)
+	require.ElementsMatch(t, []Uid{alice.Uid(), mallory.own_info.Uid}, uids)
+}
+
+func TestVerifyContact(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	require.Nil(t, db.SaveNewUid(alice.Uid(), "alice", ""))
+	require.Nil(t, db.PinIdentityKey(alice.Uid(), alice.SignKey()))
+
+	gs.processCommand("verify alice")
+	info := (<-gs.UxEvents).(SafetyNumberInfo)
+	require.Equal(t, alice.Uid(), info.Uid)
+	require.Equal(t, SafetyNumber(alice.SignKey(), bob.SignKey()), info.Number)
+
+	// Another alice makes the name ambiguous, uid prefix picks one.
+	impostor := newTestIdentity(t)
+	require.Nil(t, db.SaveNewUid(impostor.Uid(), "alice", ""))
+	require.Nil(t, db.PinIdentityKey(impostor.Uid(), impostor.SignKey()))
+	gs.processCommand("verify alice")
+	require.Empty(t, gs.UxEvents)
+	gs.processCommand("verify " + string(alice.Uid()[:12]))
+	info = (<-gs.UxEvents).(SafetyNumberInfo)
+	require.Equal(t, alice.Uid(), info.Uid)
+	require.Equal(t, "alice", info.Name)
+	gs.processCommand("unverify alice")
+	require.Empty(t, gs.UxEvents)
+
+	gs.SetVerified(alice.Uid(), true)
+	(<-gs.commands)()
+	require.Equal(t, ContactVerified{Uid: alice.Uid(), Verified: true}, <-gs.UxEvents)
+	verified, err := db.GetVerifiedUids()
+	require.Nil(t, err)
+	require.True(t, verified[alice.Uid()])
+
+	// Same key keeps the flag, new key drops it.
+	require.Nil(t, db.PinIdentityKey(alice.Uid(), alice.SignKey()))
+	verified, err = db.GetVerifiedUids()
+	require.Nil(t, err)
+	require.True(t, verified[alice.Uid()])
+	require.Nil(t, db.PinIdentityKey(alice.Uid(), newTestIdentity(t).SignKey()))
+	verified, err = db.GetVerifiedUids()
+	require.Nil(t, err)
+	require.False(t, verified[alice.Uid()])
+}
+
+func TestBlockedPeerIgnored(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	carol := newTestIdentity(t)
+	require.Nil(t, db.SaveNewUid(alice.Uid(), "alice", ""))
+	require.Nil(t, db.SaveNewUid(newTestIdentity(t).Uid(), "alice", ""))
+	server.MakeNewConnectionTo(alice.Uid(), "")
+	// Ambiguous name blocks nobody.
+	gs.processCommand("block alice")
+	require.False(t, db.IsBlocked(alice.Uid()))
+	gs.processCommand("block " + string(alice.Uid()))
+	require.True(t, db.IsBlocked(alice.Uid()))
+	require.NotContains(t, server.connections, alice.Uid())
+
+	require.ErrorIs(t, gs.admitPeer(ConnectInfo{MyUid: alice.Uid(), IdentityKey: alice.SignKey()}), ErrBlocked)
+
+	announce := alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+	gs.processDiscoveryEvent(DiscoveryInfo{
+		ClientId:   announce.Uid,
+		ClientName: announce.Name,
+		Endpoint:   announce.Endpoint,
+		PublicKey:  announce.PublicKey,
+		Signature:  announce.Signature,
+	})
+	require.Empty(t, gs.connCandidate)
+
+	key, err := NewChatKey()
+	require.Nil(t, err)
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{alice.Uid(), bob.Uid(), carol.Uid()}, key))
+	newMsg := func(author *Identity, index uint32) ChatMessage {
+		sealed, err := SealText("text", key)
+		require.Nil(t, err)
+		return author.SignMessage(ChatMessage{Uid: author.Uid(), Cid: "cid", Index: index, Sealed: sealed})
+	}
+	gs.processNetworkEvent(NetEvent{From: alice.Uid(), Msg: newMsg(carol, 1)})
+	pack := ChatMessagePack{From: carol.Uid(), To: bob.Uid(), Messages: []ChatMessage{newMsg(alice, 1), newMsg(carol, 2)}}
+	gs.processNetworkEvent(NetEvent{From: carol.Uid(), Msg: pack})
+	msgs, err := db.GetMessages("cid", 0, 1000)
+	require.Nil(t, err)
+	require.Len(t, msgs, 1)
+	require.Equal(t, carol.Uid(), msgs[0].Uid)
+
+	// Connection that is still there is skipped when sending.
+	server.MakeNewConnectionTo(alice.Uid(), "")
+	server.MakeNewConnectionTo(carol.Uid(), "")
+	require.Nil(t, gs.UserMessage(ChatMessage{Cid: "cid", Text: "text"}))
+	require.IsType(t, ChatMessagePack{}, <-gs.UxEvents)
+	require.IsType(t, ChatMessage{}, <-gs.UxEvents)
+	require.Empty(t, server.msgs[alice.Uid()])
+	require.Len(t, server.msgs[carol.Uid()], 1)
+
+	// Invite that came before the disconnect is declined without asking.
+	invite := InviteForJoin{From: alice.Uid(), To: bob.Uid(), Chat: ChatInfo{Cid: "cid2", Participants: []Uid{alice.Uid()}}}
+	gs.processNetworkEvent(NetEvent{From: alice.Uid(), Msg: invite})
+	require.Empty(t, gs.UxEvents)
+	require.Equal(t, []any{DeclineInvite{From: bob.Uid(), To: alice.Uid(), Cid: "cid2"}}, server.msgs[alice.Uid()])
+	invites, err := db.GetIncomingInvites()
+	require.Nil(t, err)
+	require.Empty(t, invites)
+
+	gs.processCommand("unblock " + string(alice.Uid()))
+	require.False(t, db.IsBlocked(alice.Uid()))
+}
+
+func TestJoinChatOnlyForPendingInvite(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: "bob"}, newTestIdentity(t))
+	require.Nil(t, err)
+	require.Nil(t, db.SaveNewChat("cid", "chat", []Uid{"bob"}, nil))
+	participants := func() []Uid {
+		info, err := db.GetChatInfo("cid")
+		require.Nil(t, err)
+		return info.Participants
+	}
+
+	gs.processNetworkEvent(NetEvent{From: "mallory", Msg: JoinChat{From: "mallory", To: "bob", Cid: "cid"}})
+	require.Equal(t, []Uid{"bob"}, participants())
+
+	require.Nil(t, db.AddPendingInvite("cid", "alice", time.Now().Add(time.Hour)))
+	// Invite is for alice, mallory cannot use it by naming her as sender.
+	gs.processNetworkEvent(NetEvent{From: "mallory", Msg: JoinChat{From: "alice", To: "bob", Cid: "cid"}})
+	require.Equal(t, []Uid{"bob"}, participants())
+
+	gs.processNetworkEvent(NetEvent{From: "alice", Msg: JoinChat{From: "alice", To: "bob", Cid: "cid"}})
+	require.Equal(t, []Uid{"bob", "alice"}, participants())
+	<-gs.UxEvents
+
+	// Invite is used up.
+	ok, err := db.TakePendingInvite("cid", "alice", time.Now())
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	require.Nil(t, db.AddPendingInvite("cid", "carol", time.Now().Add(time.Hour)))
+	ok, err = db.TakePendingInvite("cid", "carol", time.Now().Add(2*time.Hour))
+	require.Nil(t, err)
+	require.False(t, ok)
+}
+
+func TestDeclineInvite(t *testing.T) {
+	server := NewFakeServer()
+	server.MakeNewConnectionTo("alice", "")
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: "bob"}, newTestIdentity(t))
+	require.Nil(t, err)
+
+	invite := IncomingInvite{From: "alice", Chat: ChatInfo{Cid: "cid", Name: "group", Participants: []Uid{"alice"}, Group: true}}
+	require.Nil(t, db.SaveIncomingInvite(invite, []byte("key")))
+	stored, key, err := db.GetIncomingInvite("cid")
+	require.Nil(t, err)
+	require.Equal(t, invite, stored)
+	require.Equal(t, []byte("key"), key)
+
+	gs.processCommand("decline")
+	require.Equal(t, []any{DeclineInvite{From: "bob", To: "alice", Cid: "cid"}}, server.msgs["alice"])
+	_, _, err = db.GetIncomingInvite("cid")
+	require.NotNil(t, err)
+	info, err := db.GetChatInfo("cid")
+	require.Nil(t, err)
+	require.Nil(t, info)
+}
+
+func TestDeclinedInviteRemovesChat(t *testing.T) {
+	alice := newTestIdentity(t)
+	server := NewFakeServer()
+	server.MakeNewConnectionTo("alice", "")
+	server.boxKeys["alice"] = alice.Box.Public[:]
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, UserLightInfo{Name: "bob", Uid: "bob"}, newTestIdentity(t))
+	require.Nil(t, err)
+
+	gs.connCandidate["alice"] = DiscoveryInfo{ClientId: "alice", ClientName: "alice"}
+	gs.processCommand("conn alice")
+	chat := (<-gs.UxEvents).(ChatUpdate).Info
+	invite := server.msgs["alice"][0].(InviteForJoin)
+	require.Equal(t, chat.Cid, invite.Chat.Cid)
+
+	// Decline from someone else is ignored.
+	gs.processNetworkEvent(NetEvent{From: "mallory", Msg: DeclineInvite{From: "mallory", To: "bob", Cid: chat.Cid}})
+	require.Empty(t, gs.UxEvents)
+
+	gs.processNetworkEvent(NetEvent{From: "alice", Msg: DeclineInvite{From: "alice", To: "bob", Cid: chat.Cid}})
+	declined := (<-gs.UxEvents).(InviteDeclined)
+	require.Equal(t, Uid("alice"), declined.From)
+	require.Equal(t, chat.Cid, declined.Chat.Cid)
+	require.True(t, declined.Removed)
+	info, err := db.GetChatInfo(chat.Cid)
+	require.Nil(t, err)
+	require.Nil(t, info)
+}
+
+func TestDiscoveryPresence(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	found := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"}))
+	found.Source = BackendMulticast
+	gs.processDiscoveryEvent(found)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMulticast}}, <-gs.UxEvents)
+	require.Equal(t, "127.0.0.1:1", gs.connCandidate["alice"].Endpoint)
+
+	moved := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice2", Endpoint: "127.0.0.1:2"}))
+	moved.Source = BackendMulticast
+	gs.processDiscoveryEvent(NodeChanged{Info: moved, Old: found})
+	require.Empty(t, gs.UxEvents)
+	require.NotContains(t, gs.connCandidate, "alice")
+
+	gs.processDiscoveryEvent(NodeLost{Uid: alice.Uid(), Name: "alice2", Source: BackendMulticast})
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: false}, <-gs.UxEvents)
+	require.Empty(t, gs.connCandidate)
+}
+
+func TestConnectedNodeIsNotDialedAgain(t *testing.T) {
+	server := NewFakeServer()
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	require.Nil(t, db.SaveNewUid(alice.Uid(), "alice", ""))
+	require.Nil(t, db.PinIdentityKey(alice.Uid(), alice.SignKey()))
+	// Alice dialed us before her announce came.
+	server.connections[alice.Uid()] = "10.0.0.1:40000"
+	found := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "10.0.0.1:7000"}))
+	found.Source = BackendMulticast
+	gs.processDiscoveryEvent(found)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMulticast}}, <-gs.UxEvents)
+	gs.processDiscoveryEvent(found)
+	moved := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "10.0.0.2:7000"}))
+	moved.Source = BackendMulticast
+	gs.processDiscoveryEvent(NodeChanged{Info: moved, Old: found})
+	require.Equal(t, "10.0.0.1:40000", server.connections[alice.Uid()])
+}
+
+func TestPresenceFollowsDiscoveryBackends(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	multicast := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "10.0.0.1:7000"}))
+	multicast.Source = BackendMulticast
+	mdns := multicast
+	mdns.Source = BackendMdns
+	merger := newDiscoveryMerger()
+	process := func(ev interface{}) {
+		for _, out := range merger.merge(ev) {
+			gs.processDiscoveryEvent(out)
+		}
+	}
+
+	process(multicast)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMulticast}}, <-gs.UxEvents)
+	process(mdns)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMdns, BackendMulticast}}, <-gs.UxEvents)
+	process(NodeLost{Uid: alice.Uid(), Name: "alice", Source: BackendMulticast})
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMdns}}, <-gs.UxEvents)
+	require.Equal(t, alice.Uid(), gs.connCandidate["alice"].ClientId)
+	process(NodeLost{Uid: alice.Uid(), Name: "alice", Source: BackendMdns})
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: false}, <-gs.UxEvents)
+}
+
+func TestPresenceKeepsOtherSources(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	found := discoveryInfo(alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "10.0.0.1:7000"}))
+	found.Source = BackendMulticast
+	gs.processDiscoveryEvent(found)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMulticast}}, <-gs.UxEvents)
+
+	// Static peer turns out to be the same node.
+	server.listeners["10.0.0.1:7000"] = ConnectInfo{MyUid: alice.Uid(), MyName: "alice", IdentityKey: alice.SignKey()}
+	gs.processDiscoveryEvent(PeerAddress{Endpoint: "10.0.0.1:7000"})
+	gs.onDialed(<-gs.dials)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendMulticast, BackendStatic}}, <-gs.UxEvents)
+	gs.processNetworkEvent(PeerConnected{Uid: alice.Uid(), Name: "alice"})
+	require.Empty(t, gs.UxEvents)
+
+	// Multicast lost the node, but connection is still alive.
+	gs.processDiscoveryEvent(NodeLost{Uid: alice.Uid(), Name: "alice", Source: BackendMulticast})
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{BackendStatic}}, <-gs.UxEvents)
+
+	gs.processNetworkEvent(PeerDisconnected{Uid: alice.Uid(), Name: "alice"})
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: false}, <-gs.UxEvents)
+}
+
+func TestConnectByAddress(t *testing.T) {
+	server := NewFakeServer()
+	discovery := FakeDiscovery{}
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &discovery, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+
+	alice := newTestIdentity(t)
+	server.listeners["10.0.0.1:7000"] = ConnectInfo{MyUid: alice.Uid(), MyName: "alice", IdentityKey: alice.SignKey()}
+	gs.processCommand("connect 10.0.0.2:7000")
+	gs.onDialed(<-gs.dials)
+	require.False(t, db.IsKnownUid(alice.Uid()))
+
+	gs.processCommand("connect 10.0.0.1:7000")
+	gs.onDialed(<-gs.dials)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{sourceManual}}, <-gs.UxEvents)
+	require.True(t, db.IsKnownUid(alice.Uid()))
+	key, err := db.GetIdentityKey(alice.Uid())
+	require.Nil(t, err)
+	require.Equal(t, []byte(alice.SignKey()), key)
+	require.Equal(t, alice.Uid(), gs.connCandidate["alice"].ClientId)
+
+	// Static peer that is still connected is not dialed again.
+	gs.staticPeers["10.0.0.1:7000"] = alice.Uid()
+	delete(server.listeners, "10.0.0.1:7000")
+	gs.processDiscoveryEvent(PeerAddress{Endpoint: "10.0.0.1:7000"})
+	require.Equal(t, alice.Uid(), gs.staticPeers["10.0.0.1:7000"])
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{sourceManual, BackendStatic}}, <-gs.UxEvents)
+}
+
+func TestConnectDoesNotBlockService(t *testing.T) {
+	server := NewFakeServer()
+	server.dialGate = make(chan struct{})
+	logger := loggo.GetLogger("default")
+	db, err := NewDb("")
+	require.Nil(t, err)
+	bob := newTestIdentity(t)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, UserLightInfo{Name: "bob", Uid: bob.Uid()}, bob)
+	require.Nil(t, err)
+	t.Cleanup(func() { gs.Stop() })
+
+	alice := newTestIdentity(t)
+	server.listeners["10.0.0.1:7000"] = ConnectInfo{MyUid: alice.Uid(), MyName: "alice", IdentityKey: alice.SignKey()}
+	// Both return while the dial hangs, and the second one does not dial again.
+	gs.processCommand("connect 10.0.0.1:7000")
+	gs.processDiscoveryEvent(PeerAddress{Endpoint: "10.0.0.1:7000"})
+	require.True(t, gs.dialing["10.0.0.1:7000"])
+
+	close(server.dialGate)
+	gs.onDialed(<-gs.dials)
+	require.Equal(t, Presence{Uid: alice.Uid(), Online: true, Sources: []string{sourceManual}}, <-gs.UxEvents)
+	require.Empty(t, gs.dialing)
+	select {
+	case res := <-gs.dials:
+		t.Fatalf("Dialed %s twice", res.endpoint)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnectCommandWhileNodesAreDiscovered(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	bob := newTestIdentity(t)
+	own := UserLightInfo{Name: "bob", Uid: bob.Uid()}
+	server, err := NewServer(own, bob, DefaultServerConfig(), &logger)
+	require.Nil(t, err)
+	db, err := NewDb("")
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, own, bob)
+	require.Nil(t, err)
+	t.Cleanup(func() { gs.Stop() })
+	gs.Launch()
+	alice, _ := newTestServer(t, "alice")
+
+	nodes := make([]DiscoveryInfo, 50)
+	for i := range nodes {
+		node := newTestIdentity(t)
+		nodes[i] = discoveryInfo(node.SignAnnounce(NodeAnnounce{Uid: node.Uid(), Name: fmt.Sprint("node", i), Endpoint: "127.0.0.1:1"}))
+	}
+	go func() {
+		for _, node := range nodes {
+			select {
+			case gs.discoveryEvents <- node:
+			case <-gs.ctx.Done():
+				return
+			}
+		}
+	}()
+	// Like tui does, user types in own goroutine.
+	go gs.UserMessage(ChatMessage{Text: "!connect " + alice.ListenerAddress()})
+
+	for {
+		select {
+		case ev := <-gs.UxEvents:
+			if presence, ok := ev.(Presence); ok && presence.Uid == alice.own_info.Uid {
+				require.Equal(t, []string{sourceManual}, presence.Sources)
+				require.True(t, db.IsKnownUid(alice.own_info.Uid))
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No connection to alice")
+		}
+	}
+}
+
+func TestStopWaitsForGoroutinesAndClosesDb(t *testing.T) {
+	logger := loggo.GetLogger("default")
+	identity := newTestIdentity(t)
+	own := UserLightInfo{Name: "bob", Uid: identity.Uid()}
+	server, err := NewServer(own, identity, DefaultServerConfig(), &logger)
+	require.Nil(t, err)
+	db, err := NewDb(filepath.Join(t.TempDir(), "glink.db"))
+	require.Nil(t, err)
+	gs, err := createService(&logger, db, server, &FakeDiscovery{}, own, identity)
+	require.Nil(t, err)
+	gs.Launch()
+
+	// Nobody reads UxEvents, service loop gets stuck on the third event.
+	for i := 0; i < 3; i++ {
+		alice := newTestIdentity(t)
+		announce := alice.SignAnnounce(NodeAnnounce{Uid: alice.Uid(), Name: "alice", Endpoint: "127.0.0.1:1"})
+		gs.discoveryEvents <- discoveryInfo(announce)
+	}
+
+	stopped := make(chan error)
+	go func() { stopped <- gs.Stop() }()
+	select {
+	case err := <-stopped:
+		require.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hangs")
+	}
+	require.NotNil(t, db.db.Ping())
+	_, err = net.Dial("tcp", server.ListenerAddress())
+	require.NotNil(t, err)
+	require.Nil(t, gs.Stop())
+}
 
 // user command
 
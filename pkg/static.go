@@ -0,0 +1,58 @@
+package glink
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// staticRetryInterval is how often StaticDiscovery reminds about its peers,
+// so that the service reconnects to the ones that went away.
+const staticRetryInterval = 10 * time.Second
+
+// PeerAddress is an endpoint of a peer with unknown identity. The service
+// connects to it and learns who is there from the handshake.
+type PeerAddress struct {
+	Endpoint string
+}
+
+// StaticDiscovery reports fixed list of endpoints. It is for networks where
+// multicast does not work at all, like VPN or different subnets.
+type StaticDiscovery struct {
+	peers  []string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewStaticDiscovery(peers []string) *StaticDiscovery {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &StaticDiscovery{peers: peers, ctx: ctx, cancel: cancel}
+}
+
+func (d *StaticDiscovery) Run(eventChan chan interface{}) error {
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		for {
+			for _, endpoint := range d.peers {
+				select {
+				case eventChan <- PeerAddress{Endpoint: endpoint}:
+				case <-d.ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-time.After(staticRetryInterval):
+			case <-d.ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (d *StaticDiscovery) Close() {
+	d.cancel()
+	d.wg.Wait()
+}
@@ -0,0 +1,111 @@
+package glink
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var ErrBadPeerCertificate = errors.New("Bad peer certificate")
+
+// newTlsConfig returns config used both to dial and to accept connections.
+// Every node presents a self-signed certificate made from its identity key
+// with own Uid as common name. There is no CA, so chain verification is
+// replaced by verifyPeerCertificate; the handshake itself proves that the
+// peer owns the certificate key.
+func newTlsConfig(own_info UserLightInfo, identity *Identity) (*tls.Config, error) {
+	cert, err := selfSignedCertificate(own_info.Uid, identity.Sign)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot create certificate: %w", err)
+	}
+	return &tls.Config{
+		Certificates:          []tls.Certificate{cert},
+		MinVersion:            tls.VersionTLS13,
+		ClientAuth:            tls.RequireAnyClientCert,
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyPeerCertificate,
+	}, nil
+}
+
+func selfSignedCertificate(uid Uid, key ed25519.PrivateKey) (tls.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: string(uid)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+func verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("%w: no certificate", ErrBadPeerCertificate)
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadPeerCertificate, err)
+	}
+	if _, ok := cert.PublicKey.(ed25519.PublicKey); !ok {
+		return fmt.Errorf("%w: not ed25519 key", ErrBadPeerCertificate)
+	}
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBadPeerCertificate, err)
+	}
+	now := time.Now()
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return fmt.Errorf("%w: expired", ErrBadPeerCertificate)
+	}
+	return nil
+}
+
+// peerIdentity returns Uid and identity key the peer proved during TLS
+// handshake. The handshake proves only the key, so Uid is derived from it and
+// certificates with common name of another Uid are refused.
+func peerIdentity(state tls.ConnectionState) (Uid, ed25519.PublicKey, error) {
+	if len(state.PeerCertificates) == 0 {
+		return "", nil, fmt.Errorf("%w: no certificate", ErrBadPeerCertificate)
+	}
+	cert := state.PeerCertificates[0]
+	key, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: not ed25519 key", ErrBadPeerCertificate)
+	}
+	uid := UidFromKey(key)
+	if Uid(cert.Subject.CommonName) != uid {
+		return "", nil, fmt.Errorf("%w: common name %s is not uid of the key", ErrBadPeerCertificate, cert.Subject.CommonName)
+	}
+	return uid, key, nil
+}
+
+// checkPeerIdentity makes sure ConnectInfo claims the same Uid and key the
+// peer proved in TLS handshake, and the Uid is derived from that key.
+func checkPeerIdentity(info ConnectInfo, uid Uid, key ed25519.PublicKey) error {
+	err := verifyUidKey(uid, key)
+	if err != nil {
+		return err
+	}
+	if info.MyUid != uid {
+		return fmt.Errorf("Peer claims uid %s, but certificate is for %s", info.MyUid, uid)
+	}
+	if !key.Equal(ed25519.PublicKey(info.IdentityKey)) {
+		return fmt.Errorf("Identity key of %s does not match certificate", uid)
+	}
+	return nil
+}
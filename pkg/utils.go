@@ -21,15 +21,15 @@ func SplitUids(s, sep string) []Uid {
 		panic("cannot have empty separator")
 	}
 
-	out := make([]Uid, 5)
-	for i:= 0; i < len(s); {
+	out := make([]Uid, 0, 5)
+	for i := 0; i < len(s); {
 		next := strings.Index(s[i:], sep)
 		if next == -1 {
 			out = append(out, Uid(s[i:]))
 			break
 		}
-		out = append(out, Uid(s[i:next]))
-		i = next
+		out = append(out, Uid(s[i:i+next]))
+		i += next + len(sep)
 	}
 	return out
 }
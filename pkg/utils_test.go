@@ -0,0 +1,25 @@
+package glink
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitUids(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		sep  string
+		uids []Uid
+	}{
+		{"", ",", []Uid{}},
+		{"a", ",", []Uid{"a"}},
+		{"a,b,c", ",", []Uid{"a", "b", "c"}},
+		{"ab::cd::e", "::", []Uid{"ab", "cd", "e"}},
+		{"a:b::c", "::", []Uid{"a:b", "c"}},
+	} {
+		uids := SplitUids(tc.s, tc.sep)
+		require.Equal(t, tc.uids, uids, "%q by %q", tc.s, tc.sep)
+		require.Equal(t, tc.s, JoinUids(uids, tc.sep))
+	}
+}